@@ -0,0 +1,28 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alibaba/pouch/apis/types"
+	"github.com/alibaba/pouch/daemon/mgr"
+	"github.com/alibaba/pouch/version"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_version_with_min_api_version(t *testing.T) {
+	s := Server{SystemMgr: &mgr.SystemManager{}}
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/version", nil)
+	assert.NoError(t, s.version(context.Background(), rw, req))
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	var v types.SystemVersion
+	assert.NoError(t, json.NewDecoder(rw.Body).Decode(&v))
+	assert.Equal(t, version.APIVersion, v.APIVersion)
+	assert.Equal(t, version.MinAPIVersion, v.MinAPIVersion)
+}
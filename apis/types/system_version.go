@@ -32,6 +32,9 @@ type SystemVersion struct {
 	// Operating system kernel version
 	KernelVersion string `json:"KernelVersion,omitempty"`
 
+	// Minimum Api Version supported by daemon
+	MinAPIVersion string `json:"MinAPIVersion,omitempty"`
+
 	// Operating system type of underlying system
 	Os string `json:"Os,omitempty"`
 
@@ -11,6 +11,7 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/alibaba/pouch/apis/opts"
 	"github.com/alibaba/pouch/apis/types"
 	"github.com/alibaba/pouch/client"
 	criconfig "github.com/alibaba/pouch/cri/config"
@@ -95,6 +96,36 @@ type Config struct {
 	// QuotaDriver is used to set the driver of Quota
 	QuotaDriver string `json:"quota-driver,omitempty"`
 
+	// QuotaToolPaths is used to set the paths of quota tools, such as setquota and chattr,
+	// the tools are looked up in PATH if not set.
+	QuotaToolPaths map[string]string `json:"quota-tool-paths,omitempty"`
+
+	// QuotaMounts is the mounts which project quota is enabled on at startup.
+	QuotaMounts []string `json:"quota-mount,omitempty"`
+
+	// QuotaRemountOptions is the comma separated options appended to the existing
+	// mount options when the mountpoint is remounted with prjquota, such as usrquota.
+	QuotaRemountOptions string `json:"quota-remount-options,omitempty"`
+
+	// QuotaIDConflictError makes setting a quota id on the directory which holds another
+	// one fail, instead of reassigning the requested quota id recursively.
+	QuotaIDConflictError bool `json:"quota-id-conflict-error,omitempty"`
+
+	// QuotaDenyDirs is the directories which quota is never applied on, besides the host root.
+	QuotaDenyDirs []string `json:"quota-deny-dir,omitempty"`
+
+	// QuotaPollingInterval is the interval in seconds to poll the disk usage of directory
+	// which kernel quota can not be enforced on, 0 means no polling fallback.
+	QuotaPollingInterval int `json:"quota-polling-interval,omitempty"`
+
+	// QuotaInheritOnlyThreshold is the number of files in directory, above which the quota id
+	// is only set on the directories with inherit flag instead of on every file, 0 means no limit.
+	QuotaInheritOnlyThreshold int `json:"quota-inherit-only-threshold,omitempty"`
+
+	// DefaultDiskQuota is the disk quota applied to the container created without one,
+	// it is in the same format as the disk quota of container, such as "10g" or "/=10g".
+	DefaultDiskQuota []string `json:"default-disk-quota,omitempty"`
+
 	// Configuration file of pouchd
 	ConfigFile string `json:"config-file,omitempty"`
 
@@ -177,6 +208,10 @@ func (cfg *Config) Validate() error {
 
 	// TODO: add config validation
 
+	if _, err := opts.ParseDiskQuota(cfg.DefaultDiskQuota); err != nil {
+		return fmt.Errorf("invalid default disk quota: %v", err)
+	}
+
 	// validates runtimes config
 	if len(cfg.Runtimes) == 0 {
 		cfg.Runtimes = make(map[string]types.Runtime)
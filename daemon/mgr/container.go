@@ -388,6 +388,11 @@ func (mgr *ContainerManager) Create(ctx context.Context, name string, config *ty
 		return nil, errors.Wrapf(errtypes.ErrInvalidParam, "NetworkingConfig cannot be empty")
 	}
 
+	// apply default disk quota if client specifies none
+	if err := mgr.applyDefaultDiskQuota(config); err != nil {
+		return nil, errors.Wrapf(err, "failed to apply default disk quota")
+	}
+
 	// validate disk quota
 	if err := mgr.validateDiskQuota(config); err != nil {
 		return nil, errors.Wrapf(err, "invalid disk quota config")
@@ -794,6 +799,13 @@ func (mgr *ContainerManager) createContainerdContainer(ctx context.Context, c *C
 		}
 	}
 
+	// the quota of rootfs is set at create time, verify it again since
+	// the quota id in file attr may be lost before start. The failure does
+	// not fail the start, as the failure to set quota at create time does not.
+	if err := mgr.preStartQuota(ctx, c); err != nil {
+		log.With(ctx).Warnf("failed to verify rootfs quota of container %s: %v", c.ID, err)
+	}
+
 	if mgr.containerPlugin != nil {
 		// TODO: make func PreStart with no data race
 		prioArr, argsArr, err = mgr.containerPlugin.PreStart(ctx, c)
@@ -1335,6 +1347,8 @@ func (mgr *ContainerManager) Remove(ctx context.Context, name string, options *t
 		log.With(ctx).Errorf("failed to detach volume: %v", err)
 	}
 
+	mgr.releaseQuota(ctx, c)
+
 	// if creating the container by specify rootfs,
 	// we should umount the rootfs when delete the container.
 	if c.RootFSProvided {
@@ -15,6 +15,7 @@ import (
 
 	"github.com/alibaba/pouch/apis/opts"
 	"github.com/alibaba/pouch/apis/types"
+	"github.com/alibaba/pouch/hookplugins"
 	"github.com/alibaba/pouch/pkg/archive"
 	"github.com/alibaba/pouch/pkg/errtypes"
 	"github.com/alibaba/pouch/pkg/log"
@@ -512,6 +513,28 @@ func (mgr *ContainerManager) getDiskQuotaMountPoints(ctx context.Context, c *Con
 	return mounts, nil
 }
 
+// applyDefaultDiskQuota sets the default disk quota of daemon on the container created
+// without disk quota, the disk quota specified by client always wins. The quota id is
+// parsed from the default one as the client does.
+func (mgr *ContainerManager) applyDefaultDiskQuota(config *types.ContainerCreateConfig) error {
+	if len(config.DiskQuota) > 0 || mgr.Config == nil || len(mgr.Config.DefaultDiskQuota) == 0 {
+		return nil
+	}
+
+	quotaMaps, err := opts.ParseDiskQuota(mgr.Config.DefaultDiskQuota)
+	if err != nil {
+		return err
+	}
+	quotaID, err := opts.ParseQuotaID(config.QuotaID, mgr.Config.DefaultDiskQuota)
+	if err != nil {
+		return err
+	}
+
+	config.DiskQuota = quotaMaps
+	config.QuotaID = quotaID
+	return nil
+}
+
 func (mgr *ContainerManager) prepareQuotaMap(ctx context.Context, c *Container, mounted bool) ([]*quota.QMap, error) {
 	// get default quota
 	var (
@@ -547,45 +570,7 @@ func (mgr *ContainerManager) prepareQuotaMap(ctx context.Context, c *Container,
 	var qms []*quota.QMap
 	for _, mp := range mounts {
 		// get quota size
-		var (
-			found bool
-			qm    *quota.QMap
-		)
-		for exp, size := range quotas {
-			if strings.Contains(exp, "&") {
-				for _, p := range strings.Split(exp, "&") {
-					if p == mp.Destination {
-						found = true
-						qm = &quota.QMap{
-							Source:      mp.Source,
-							Destination: mp.Destination,
-							Expression:  exp,
-							Size:        size,
-						}
-						break
-					}
-				}
-			} else {
-				re := regexp.MustCompile(exp)
-
-				findStr := re.FindString(mp.Destination)
-				if findStr == mp.Destination {
-					qm = &quota.QMap{
-						Source:      mp.Source,
-						Destination: mp.Destination,
-						Size:        size,
-					}
-					if exp != ".*" {
-						break
-					}
-				}
-			}
-
-			if found {
-				break
-			}
-		}
-
+		qm := matchQuotaMap(quotas, mp)
 		if qm != nil {
 			// check duplicate quota map
 			prev := checkDupQuotaMap(qms, qm)
@@ -610,6 +595,43 @@ func (mgr *ContainerManager) prepareQuotaMap(ctx context.Context, c *Container,
 	return qms, nil
 }
 
+// matchQuotaMap returns the quota map of mount point by the disk quota expressions,
+// nil if none matches its destination. The expression joined by "&" lists the
+// destinations exactly, and ".*" is overridden by the other matched expressions.
+func matchQuotaMap(quotas map[string]string, mp *types.MountPoint) *quota.QMap {
+	var qm *quota.QMap
+	for exp, size := range quotas {
+		if strings.Contains(exp, "&") {
+			for _, p := range strings.Split(exp, "&") {
+				if p == mp.Destination {
+					return &quota.QMap{
+						Source:      mp.Source,
+						Destination: mp.Destination,
+						Expression:  exp,
+						Size:        size,
+					}
+				}
+			}
+			continue
+		}
+
+		re := regexp.MustCompile(exp)
+
+		findStr := re.FindString(mp.Destination)
+		if findStr == mp.Destination {
+			qm = &quota.QMap{
+				Source:      mp.Source,
+				Destination: mp.Destination,
+				Size:        size,
+			}
+			if exp != ".*" {
+				return qm
+			}
+		}
+	}
+	return qm
+}
+
 func checkDupQuotaMap(qms []*quota.QMap, qm *quota.QMap) *quota.QMap {
 	for _, prev := range qms {
 		if qm.Expression != "" && qm.Expression == prev.Expression {
@@ -620,19 +642,17 @@ func checkDupQuotaMap(qms []*quota.QMap, qm *quota.QMap) *quota.QMap {
 }
 
 func (mgr *ContainerManager) setDiskQuota(ctx context.Context, c *Container, update bool, qms []*quota.QMap) error {
-	var (
-		err error
-	)
-
 	// make quota effective
 	for _, qm := range qms {
 		if qm.Destination == "/" {
 			// set rootfs quota
-			_, err = quota.SetRootfsDiskQuota(qm.Source, qm.Size, qm.QuotaID, update)
+			id, err := quota.SetRootfsDiskQuota(qm.Source, qm.Size, qm.QuotaID, update)
 			if err != nil {
 				log.With(ctx).Warnf("failed to set rootfs quota, mountfs(%s), size(%s), quota id(%d), err(%v)",
 					qm.Source, qm.Size, qm.QuotaID, err)
+				continue
 			}
+			setRootfsQuotaAnnotation(c, id, qm.Size)
 		} else {
 			err := quota.SetDiskQuota(qm.Source, qm.Size, qm.QuotaID)
 			if err != nil {
@@ -645,6 +665,137 @@ func (mgr *ContainerManager) setDiskQuota(ctx context.Context, c *Container, upd
 	return nil
 }
 
+// preStartQuota calls the pre-start quota hook of container plugin if it implements
+// ContainerQuotaPlugin, to verify the quota id of rootfs which is set by setDiskQuota
+// at create time. It does nothing if the container has no disk quota. The quota id in
+// effect is saved in config of container, which is persisted when container starts.
+func (mgr *ContainerManager) preStartQuota(ctx context.Context, c *Container) error {
+	if len(c.Config.DiskQuota) == 0 || c.Snapshotter == nil || c.Snapshotter.Data == nil {
+		return nil
+	}
+	plugin, ok := mgr.containerPlugin.(hookplugins.ContainerQuotaPlugin)
+	if !ok {
+		return nil
+	}
+
+	qm := matchQuotaMap(c.Config.DiskQuota, &types.MountPoint{Destination: "/"})
+	if qm == nil {
+		return nil
+	}
+
+	var quotaID uint32
+	if quota.IsSetQuotaID(c.Config.QuotaID) {
+		id, err := strconv.Atoi(c.Config.QuotaID)
+		if err != nil {
+			return errors.Wrapf(err, "invalid argument, QuotaID(%s)", c.Config.QuotaID)
+		}
+		if id > 0 {
+			quotaID = uint32(id)
+		}
+	}
+
+	id, err := plugin.PreStartQuota(ctx, c.Snapshotter.Data["UpperDir"], c.Snapshotter.Data["WorkDir"], qm.Size, quotaID)
+	if err != nil {
+		return err
+	}
+	if id == 0 {
+		return nil
+	}
+	if id != quotaID && quota.IsSetQuotaID(c.Config.QuotaID) {
+		c.Config.QuotaID = strconv.Itoa(int(id))
+	}
+	setRootfsQuotaAnnotation(c, id, qm.Size)
+	return nil
+}
+
+// setRootfsQuotaAnnotation records the quota id and size applied on container rootfs
+// in the spec annotations of container, so that inspect shows the quota in effect even
+// if the quota id is chosen by driver. The quota id 0 means no quota id is used, such
+// as the rootfs lies on tmpfs. The annotations are persisted with container config.
+func setRootfsQuotaAnnotation(c *Container, id uint32, size string) {
+	if c.Config.SpecAnnotation == nil {
+		c.Config.SpecAnnotation = make(map[string]string)
+	}
+	if id != 0 {
+		c.Config.SpecAnnotation[hookplugins.SpecDiskQuotaID] = strconv.FormatUint(uint64(id), 10)
+	} else {
+		delete(c.Config.SpecAnnotation, hookplugins.SpecDiskQuotaID)
+	}
+	c.Config.SpecAnnotation[hookplugins.SpecDiskQuotaSize] = size
+}
+
+// releaseQuota releases the quota of container rootfs when container is removed,
+// the rootfs is no longer polled by the fallback quota driver, and its quota id is
+// released unless it is shared with other containers by QuotaID.
+func (mgr *ContainerManager) releaseQuota(ctx context.Context, c *Container) {
+	if c.Snapshotter == nil || c.Snapshotter.Data == nil {
+		return
+	}
+	upperDir, workDir := c.Snapshotter.Data["UpperDir"], c.Snapshotter.Data["WorkDir"]
+	quota.StopPolling(upperDir, workDir)
+
+	if len(c.Config.DiskQuota) == 0 || mgr.quotaIDShared(ctx, c) {
+		return
+	}
+	if err := quota.ReleaseRootfsQuota(upperDir, workDir); err != nil {
+		log.With(ctx).Warnf("failed to release rootfs quota of container %s: %v", c.ID, err)
+	}
+}
+
+// quotaIDShared returns whether the QuotaID of container is used by other containers.
+func (mgr *ContainerManager) quotaIDShared(ctx context.Context, c *Container) bool {
+	if !quota.IsSetQuotaID(c.Config.QuotaID) {
+		return false
+	}
+	cons, err := mgr.List(ctx, &ContainerListOption{
+		All: true,
+		FilterFunc: func(other *Container) bool {
+			return other.ID != c.ID && other.Config.QuotaID == c.Config.QuotaID
+		},
+	})
+	// the quota id is kept if it is unknown whether it is shared.
+	return err != nil || len(cons) > 0
+}
+
+// StopOnQuotaExceeded stops the running containers whose rootfs or volume is the
+// directory, it is the callback of the polling quota driver, which is called when
+// the disk usage of directory exceeds its quota.
+func (mgr *ContainerManager) StopOnQuotaExceeded(dir string, usage *quota.QuotaUsage) {
+	ctx := context.Background()
+	cons, err := mgr.List(ctx, &ContainerListOption{
+		FilterFunc: func(c *Container) bool {
+			return c.IsRunningOrPaused() && containerUsesDir(c, dir)
+		},
+	})
+	if err != nil {
+		log.With(ctx).Errorf("failed to list containers using dir(%s): %v", dir, err)
+		return
+	}
+
+	for _, c := range cons {
+		log.With(ctx).Warnf("stop container %s, disk usage of dir(%s) exceeds quota, used(%d), limit(%d)",
+			c.ID, dir, usage.Used, usage.Limit)
+		if err := mgr.Stop(ctx, c.ID, 0); err != nil {
+			log.With(ctx).Errorf("failed to stop container %s exceeding quota: %v", c.ID, err)
+		}
+	}
+}
+
+// containerUsesDir returns whether the directory is the rootfs upper or work dir,
+// or the source of a mount of container.
+func containerUsesDir(c *Container, dir string) bool {
+	if c.Snapshotter != nil && c.Snapshotter.Data != nil &&
+		(c.Snapshotter.Data["UpperDir"] == dir || c.Snapshotter.Data["WorkDir"] == dir) {
+		return true
+	}
+	for _, mp := range c.Mounts {
+		if mp.Source == dir {
+			return true
+		}
+	}
+	return false
+}
+
 func (mgr *ContainerManager) detachVolumes(ctx context.Context, c *Container, remove bool) error {
 	for _, mount := range c.Mounts {
 		name := mount.Name
@@ -1,6 +1,8 @@
 package mgr
 
 import (
+	"context"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -8,6 +10,10 @@ import (
 	"testing"
 
 	"github.com/alibaba/pouch/apis/types"
+	"github.com/alibaba/pouch/daemon/config"
+	"github.com/alibaba/pouch/hookplugins"
+	networktypes "github.com/alibaba/pouch/network/types"
+	"github.com/alibaba/pouch/pkg/collect"
 )
 
 func TestSortMountPoint(t *testing.T) {
@@ -127,3 +133,221 @@ func TestCopyOwnership(t *testing.T) {
 		t.Fatalf("Gid %d is not equal to %d", sysInfo.Gid, uint32(300))
 	}
 }
+
+// fakeContainerPlugin implements ContainerPlugin only.
+type fakeContainerPlugin struct{}
+
+func (p *fakeContainerPlugin) PreCreate(context.Context, *types.ContainerCreateConfig) error {
+	return nil
+}
+
+func (p *fakeContainerPlugin) PreStart(context.Context, interface{}) ([]int, [][]string, error) {
+	return nil, nil, nil
+}
+
+func (p *fakeContainerPlugin) PreCreateEndpoint(context.Context, string, []string, *networktypes.Endpoint) error {
+	return nil
+}
+
+func (p *fakeContainerPlugin) PreUpdate(ctx context.Context, in io.ReadCloser) (io.ReadCloser, error) {
+	return in, nil
+}
+
+func (p *fakeContainerPlugin) PostUpdate(context.Context, string, []string) error {
+	return nil
+}
+
+// fakeQuotaPlugin implements ContainerQuotaPlugin too, it returns the quota id
+// in effect as effectID if set.
+type fakeQuotaPlugin struct {
+	fakeContainerPlugin
+
+	upperDir, workDir, size string
+	quotaID, effectID       uint32
+	called                  int
+}
+
+func (p *fakeQuotaPlugin) PreStartQuota(ctx context.Context, upperDir, workDir, size string, quotaID uint32) (uint32, error) {
+	p.upperDir, p.workDir, p.size, p.quotaID = upperDir, workDir, size, quotaID
+	p.called++
+	if p.effectID != 0 {
+		return p.effectID, nil
+	}
+	return quotaID, nil
+}
+
+func TestPreStartQuota(t *testing.T) {
+	plugin := &fakeQuotaPlugin{}
+	mgr := &ContainerManager{containerPlugin: plugin}
+
+	c := &Container{
+		Config: &types.ContainerConfig{
+			DiskQuota: map[string]string{"/": "10g", "/data": "5g"},
+			QuotaID:   "16777217",
+		},
+		Snapshotter: &types.SnapshotterData{
+			Data: map[string]string{"UpperDir": "/snapshots/1/fs", "WorkDir": "/snapshots/1/work"},
+		},
+	}
+	if err := mgr.preStartQuota(context.TODO(), c); err != nil {
+		t.Fatalf("failed to call pre-start quota hook: %v", err)
+	}
+	if plugin.called != 1 || plugin.upperDir != "/snapshots/1/fs" || plugin.workDir != "/snapshots/1/work" ||
+		plugin.size != "10g" || plugin.quotaID != 16777217 {
+		t.Fatalf("unexpected pre-start quota hook args: %+v", plugin)
+	}
+
+	// the quota id in file attr is expected if no quota id is specified,
+	// and the quota id in effect is saved in config.
+	c.Config.QuotaID = "-1"
+	c.Config.DiskQuota = map[string]string{".*": "10g"}
+	plugin.effectID = 16777218
+	if err := mgr.preStartQuota(context.TODO(), c); err != nil {
+		t.Fatalf("failed to call pre-start quota hook: %v", err)
+	}
+	if plugin.called != 2 || plugin.size != "10g" || plugin.quotaID != 0 {
+		t.Fatalf("unexpected pre-start quota hook args: %+v", plugin)
+	}
+	if c.Config.QuotaID != "16777218" {
+		t.Fatalf("expect quota id in effect 16777218 saved in config, got %s", c.Config.QuotaID)
+	}
+	if id, size := c.Config.SpecAnnotation[hookplugins.SpecDiskQuotaID], c.Config.SpecAnnotation[hookplugins.SpecDiskQuotaSize]; id != "16777218" || size != "10g" {
+		t.Fatalf("expect quota id 16777218 and size 10g in annotations, got %s and %s", id, size)
+	}
+
+	// no hook is called if rootfs has no disk quota.
+	c.Config.DiskQuota = map[string]string{"/data": "5g"}
+	if err := mgr.preStartQuota(context.TODO(), c); err != nil {
+		t.Fatalf("failed to call pre-start quota hook: %v", err)
+	}
+	if plugin.called != 2 {
+		t.Fatalf("expect no pre-start quota hook without rootfs quota, got %d calls", plugin.called)
+	}
+
+	// no hook is called if container has no disk quota.
+	c.Config.DiskQuota = nil
+	if err := mgr.preStartQuota(context.TODO(), c); err != nil {
+		t.Fatalf("failed to call pre-start quota hook: %v", err)
+	}
+	if plugin.called != 2 {
+		t.Fatalf("expect no pre-start quota hook without disk quota, got %d calls", plugin.called)
+	}
+
+	// the container plugin without pre-start quota hook is skipped.
+	mgr.containerPlugin = &fakeContainerPlugin{}
+	c.Config.DiskQuota = map[string]string{"/": "10g"}
+	if err := mgr.preStartQuota(context.TODO(), c); err != nil {
+		t.Fatalf("expect no error without pre-start quota hook, got %v", err)
+	}
+}
+
+func TestMatchQuotaMap(t *testing.T) {
+	for _, tc := range []struct {
+		quotas     map[string]string
+		size       string
+		expression string
+	}{
+		{map[string]string{"/": "10g", ".*": "20g"}, "10g", ""},
+		{map[string]string{".*": "20g"}, "20g", ""},
+		{map[string]string{"/&/data": "30g"}, "30g", "/&/data"},
+		{map[string]string{"/data": "5g"}, "", ""},
+		{nil, "", ""},
+	} {
+		qm := matchQuotaMap(tc.quotas, &types.MountPoint{Source: "/rootfs", Destination: "/"})
+		if tc.size == "" {
+			if qm != nil {
+				t.Errorf("expect no quota map of / by %v, got %+v", tc.quotas, qm)
+			}
+			continue
+		}
+		if qm == nil || qm.Size != tc.size || qm.Expression != tc.expression || qm.Source != "/rootfs" || qm.Destination != "/" {
+			t.Errorf("expect quota map of / by %v with size %q and expression %q, got %+v", tc.quotas, tc.size, tc.expression, qm)
+		}
+	}
+}
+
+func TestContainerUsesDir(t *testing.T) {
+	c := &Container{
+		Snapshotter: &types.SnapshotterData{
+			Data: map[string]string{"UpperDir": "/snapshots/1/fs", "WorkDir": "/snapshots/1/work"},
+		},
+		Mounts: []*types.MountPoint{{Source: "/var/lib/pouch/volume/v1", Destination: "/data"}},
+	}
+	for dir, expected := range map[string]bool{
+		"/snapshots/1/fs":          true,
+		"/snapshots/1/work":        true,
+		"/var/lib/pouch/volume/v1": true,
+		"/snapshots/2/fs":          false,
+		"/data":                    false,
+	} {
+		if got := containerUsesDir(c, dir); got != expected {
+			t.Fatalf("expect containerUsesDir(%s) %v, got %v", dir, expected, got)
+		}
+	}
+}
+
+func TestQuotaIDShared(t *testing.T) {
+	mgr := &ContainerManager{cache: collect.NewSafeMap()}
+	c1 := &Container{ID: "c1", Config: &types.ContainerConfig{QuotaID: "16777217"}, State: &types.ContainerState{}}
+	c2 := &Container{ID: "c2", Config: &types.ContainerConfig{QuotaID: "16777218"}, State: &types.ContainerState{}}
+	mgr.cache.Put(c1.ID, c1)
+	mgr.cache.Put(c2.ID, c2)
+
+	if mgr.quotaIDShared(context.TODO(), c1) {
+		t.Fatalf("expect quota id of c1 not shared")
+	}
+
+	// the quota id is shared with the stopped container too.
+	c3 := &Container{ID: "c3", Config: &types.ContainerConfig{QuotaID: "16777217"}, State: &types.ContainerState{}}
+	mgr.cache.Put(c3.ID, c3)
+	if !mgr.quotaIDShared(context.TODO(), c1) {
+		t.Fatalf("expect quota id of c1 shared with c3")
+	}
+
+	// no quota id is set.
+	c4 := &Container{ID: "c4", Config: &types.ContainerConfig{}, State: &types.ContainerState{}}
+	mgr.cache.Put(c4.ID, c4)
+	if mgr.quotaIDShared(context.TODO(), c4) {
+		t.Fatalf("expect no quota id of c4 shared")
+	}
+}
+
+func TestSetRootfsQuotaAnnotation(t *testing.T) {
+	c := &Container{Config: &types.ContainerConfig{}}
+
+	setRootfsQuotaAnnotation(c, 16777217, "10g")
+	if id, size := c.Config.SpecAnnotation[hookplugins.SpecDiskQuotaID], c.Config.SpecAnnotation[hookplugins.SpecDiskQuotaSize]; id != "16777217" || size != "10g" {
+		t.Fatalf("expect quota id 16777217 and size 10g in annotations, got %s and %s", id, size)
+	}
+
+	// no quota id is used on tmpfs.
+	setRootfsQuotaAnnotation(c, 0, "20g")
+	if id, ok := c.Config.SpecAnnotation[hookplugins.SpecDiskQuotaID]; ok {
+		t.Fatalf("expect no quota id in annotations, got %s", id)
+	}
+	if size := c.Config.SpecAnnotation[hookplugins.SpecDiskQuotaSize]; size != "20g" {
+		t.Fatalf("expect size 20g in annotations, got %s", size)
+	}
+}
+
+func TestApplyDefaultDiskQuota(t *testing.T) {
+	mgr := &ContainerManager{Config: &config.Config{DefaultDiskQuota: []string{"10g"}}}
+
+	// the default disk quota is applied on the container without one.
+	cfg := &types.ContainerCreateConfig{}
+	if err := mgr.applyDefaultDiskQuota(cfg); err != nil {
+		t.Fatalf("failed to apply default disk quota: %v", err)
+	}
+	if cfg.DiskQuota[".*"] != "10g" || cfg.QuotaID != "-1" {
+		t.Fatalf("expect default disk quota .*=10g with quota id -1, got %v and %s", cfg.DiskQuota, cfg.QuotaID)
+	}
+
+	// the disk quota specified by client wins.
+	cfg = &types.ContainerCreateConfig{ContainerConfig: types.ContainerConfig{DiskQuota: map[string]string{"/": "20g"}}}
+	if err := mgr.applyDefaultDiskQuota(cfg); err != nil {
+		t.Fatalf("failed to apply default disk quota: %v", err)
+	}
+	if len(cfg.DiskQuota) != 1 || cfg.DiskQuota["/"] != "20g" || cfg.QuotaID != "" {
+		t.Fatalf("expect client disk quota /=20g kept, got %v and %s", cfg.DiskQuota, cfg.QuotaID)
+	}
+}
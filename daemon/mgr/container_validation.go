@@ -210,6 +210,15 @@ func validateResource(r *types.Resources, update bool) ([]string, error) {
 		if r.Memory > 0 && r.MemorySwap > 0 && r.MemorySwap < 2*r.Memory {
 			warnings = append(warnings, "You should typically size your swap space to approximately 2x main memory for systems with less than 2GB of RAM")
 		}
+		// memory extra works along with memory limit, it makes no sense
+		// without memory limit, and the container thrashes if it exceeds memory limit.
+		if r.MemoryExtra != nil && *r.MemoryExtra > 0 {
+			if r.Memory == 0 && !update {
+				warnings = append(warnings, "MemoryExtra takes no effect without Memory limit")
+			} else if r.Memory > 0 && *r.MemoryExtra > r.Memory {
+				warnings = append(warnings, "MemoryExtra should not be larger than Memory limit")
+			}
+		}
 		if r.MemorySwappiness != nil && !cgroupInfo.Memory.MemorySwappiness {
 			log.With(nil).Warn(MemorySwappinessWarn)
 			warnings = append(warnings, MemorySwappinessWarn)
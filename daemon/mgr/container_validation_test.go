@@ -121,6 +121,11 @@ func TestValidateResource(t *testing.T) {
 		errExpected      error
 	}
 
+	var (
+		memoryExtra      int64 = 4194304  //4m
+		largeMemoryExtra int64 = 10485760 //10m
+	)
+
 	for _, tc := range []tCase{
 		{
 			r: types.Resources{
@@ -175,6 +180,37 @@ func TestValidateResource(t *testing.T) {
 			warningsExpected: []string{},
 			errExpected:      fmt.Errorf("Minimal memory should greater than 4M"),
 		},
+		{
+			r: types.Resources{
+				Memory:      10485760,
+				MemoryExtra: &memoryExtra,
+			},
+			warningsExpected: []string{},
+			errExpected:      nil,
+		},
+		{
+			r: types.Resources{
+				Memory:      8388608,
+				MemoryExtra: &largeMemoryExtra,
+			},
+			warningsExpected: []string{"MemoryExtra should not be larger than Memory limit"},
+			errExpected:      nil,
+		},
+		{
+			r: types.Resources{
+				MemoryExtra: &memoryExtra,
+			},
+			warningsExpected: []string{"MemoryExtra takes no effect without Memory limit"},
+			errExpected:      nil,
+		},
+		{
+			r: types.Resources{
+				MemoryExtra: &memoryExtra,
+			},
+			update:           true,
+			warningsExpected: []string{},
+			errExpected:      nil,
+		},
 	} {
 		warnings, err := validateResource(&tc.r, tc.update)
 		assert.Equal(t, tc.warningsExpected, warnings)
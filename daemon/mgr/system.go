@@ -204,6 +204,7 @@ func (mgr *SystemManager) Version() (types.SystemVersion, error) {
 		GitCommit:     version.GitCommit,
 		GoVersion:     runtime.Version(),
 		KernelVersion: kernelVersion,
+		MinAPIVersion: version.MinAPIVersion,
 		Os:            runtime.GOOS,
 		Version:       version.Version,
 	}, nil
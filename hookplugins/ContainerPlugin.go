@@ -8,6 +8,14 @@ import (
 	networktypes "github.com/alibaba/pouch/network/types"
 )
 
+const (
+	// SpecDiskQuotaID is the spec annotation key of the quota id applied on container rootfs.
+	SpecDiskQuotaID = "__disk_quota_id"
+
+	// SpecDiskQuotaSize is the spec annotation key of the quota size applied on container rootfs.
+	SpecDiskQuotaSize = "__disk_quota_size"
+)
+
 // ContainerPlugin defines places where a plugin will be triggered in container lifecycle
 type ContainerPlugin interface {
 	// PreCreate defines plugin point where receives a container create request, in this plugin point user
@@ -30,6 +38,16 @@ type ContainerPlugin interface {
 	PostUpdate(context.Context, string, []string) error
 }
 
+// ContainerQuotaPlugin defines the optional plugin point of container plugin, which is detected by
+// type assertion on the registered ContainerPlugin.
+type ContainerQuotaPlugin interface {
+	// PreStartQuota defines plugin point before container starts, it verifies or re-applies the quota id
+	// of container rootfs, since the quota id set on the rootfs at create time may be lost before start.
+	// The method accepts the rootfs upper dir, work dir, quota size and quota id of container, and returns
+	// the quota id in effect.
+	PreStartQuota(context.Context, string, string, string, uint32) (uint32, error)
+}
+
 var containerPlugin ContainerPlugin
 
 // RegisterContainerPlugin is used to register container plugin.
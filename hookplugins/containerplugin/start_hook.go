@@ -4,6 +4,7 @@ import (
 	"context"
 
 	networktypes "github.com/alibaba/pouch/network/types"
+	"github.com/alibaba/pouch/storage/quota"
 )
 
 // PreStart returns an array of priority and args which will pass to runc, the every priority
@@ -13,6 +14,12 @@ func (c *contPlugin) PreStart(ctx context.Context, config interface{}) ([]int, [
 	return nil, nil, nil
 }
 
+// PreStartQuota verifies the quota id of container rootfs before container starts, and re-applies
+// it if the file attr is lost. The quota is set at create time, this catches the loss since then.
+func (c *contPlugin) PreStartQuota(ctx context.Context, upperDir, workDir, size string, quotaID uint32) (uint32, error) {
+	return quota.VerifyRootfsQuota(upperDir, workDir, size, quotaID)
+}
+
 // PreCreateEndpoint accepts the container id and env of this container, to update the config of container's endpoint.
 func (c *contPlugin) PreCreateEndpoint(ctx context.Context, cid string, env []string, endpoint *networktypes.Endpoint) error {
 	// TODO: Implemented by the developer
@@ -7,6 +7,7 @@ import (
 	"path"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/alibaba/pouch/apis/metrics"
 	"github.com/alibaba/pouch/apis/opts"
@@ -14,6 +15,7 @@ import (
 	"github.com/alibaba/pouch/apis/types"
 	"github.com/alibaba/pouch/daemon"
 	"github.com/alibaba/pouch/daemon/config"
+	"github.com/alibaba/pouch/daemon/mgr"
 	"github.com/alibaba/pouch/lxcfs"
 	"github.com/alibaba/pouch/pkg/debug"
 	"github.com/alibaba/pouch/pkg/kernel"
@@ -35,6 +37,7 @@ var (
 	sigHandles   []func() error
 	printVersion bool
 	logOpts      []string
+	quotaTools   []string
 	cfg          = &config.Config{}
 )
 
@@ -102,6 +105,14 @@ func setupFlags(cmd *cobra.Command) {
 	flagSet.StringVar(&cfg.DefaultRegistryNS, "default-registry-namespace", "library", "Default Image Registry namespace")
 	flagSet.StringVar(&cfg.ImageProxy, "image-proxy", "", "Http proxy to pull image")
 	flagSet.StringVar(&cfg.QuotaDriver, "quota-driver", "", "Set quota driver(grpquota/prjquota), if not set, it will set by kernel version")
+	flagSet.StringSliceVar(&cfg.QuotaMounts, "quota-mount", []string{}, "Set mounts which project quota is enabled on at startup")
+	flagSet.StringVar(&cfg.QuotaRemountOptions, "quota-remount-options", "", "Set options appended to the existing mount options when remounting with prjquota")
+	flagSet.BoolVar(&cfg.QuotaIDConflictError, "quota-id-conflict-error", false, "Fail to set the quota id on the directory which holds another one, instead of reassigning it")
+	flagSet.StringSliceVar(&cfg.QuotaDenyDirs, "quota-deny-dir", []string{}, "Set directories which quota is never applied on, besides the host root")
+	flagSet.StringArrayVar(&quotaTools, "quota-tool-path", nil, "Set path of quota tool, <tool=path>, such as setquota=/usr/sbin/setquota")
+	flagSet.IntVar(&cfg.QuotaPollingInterval, "quota-polling-interval", 0, "Set interval in seconds to poll disk usage of directory which kernel quota can not be enforced on, the container exceeding quota is stopped, 0 means no polling fallback")
+	flagSet.StringSliceVar(&cfg.DefaultDiskQuota, "default-disk-quota", []string{}, "Set default disk quota of container created without one, such as 10g or /=10g")
+	flagSet.IntVar(&cfg.QuotaInheritOnlyThreshold, "quota-inherit-only-threshold", 0, "Set number of files above which quota id is only set on the directories with inherit flag, the existing regular files are not accounted, 0 means always on every file")
 	flagSet.StringVar(&cfg.ConfigFile, "config-file", "/etc/pouch/config.json", "Configuration file of pouchd")
 	flagSet.StringVar(&cfg.Snapshotter, "snapshotter", "overlayfs", "Snapshotter driver of pouchd, it will be passed to containerd")
 	flagSet.BoolVar(&cfg.AllowMultiSnapshotter, "allow-multi-snapshotter", false, "If set true, pouchd will allow multi snapshotter")
@@ -162,6 +173,15 @@ func runDaemon(cmd *cobra.Command) error {
 		cfg.DefaultLogConfig.LogOpts = logOptMap
 	}
 
+	// parse quota tool paths
+	quotaToolPaths, err := utils.ConvertKVStringsToMap(quotaTools)
+	if err != nil {
+		return err
+	}
+	if len(quotaToolPaths) > 0 {
+		cfg.QuotaToolPaths = quotaToolPaths
+	}
+
 	if err := loadDaemonFile(cfg, cmd.Flags()); err != nil {
 		return fmt.Errorf("failed to load daemon file: %s", err)
 	}
@@ -222,8 +242,29 @@ func runDaemon(cmd *cobra.Command) error {
 
 	// define and start all required processes.
 
-	if cfg.QuotaDriver != "" {
-		quota.SetQuotaDriver(cfg.QuotaDriver)
+	// quota state is stored in home dir, and empty quota driver means it is set by kernel version.
+	quotaOpts := []quota.Opt{quota.WithStateDir(path.Join(cfg.HomeDir, "quota"))}
+	for tool, p := range cfg.QuotaToolPaths {
+		quotaOpts = append(quotaOpts, quota.WithToolPath(tool, p))
+	}
+	if cfg.QuotaRemountOptions != "" {
+		quotaOpts = append(quotaOpts, quota.WithRemountOptions(cfg.QuotaRemountOptions))
+	}
+	if cfg.QuotaIDConflictError {
+		quotaOpts = append(quotaOpts, quota.WithQuotaIDConflictError())
+	}
+	if len(cfg.QuotaDenyDirs) > 0 {
+		quotaOpts = append(quotaOpts, quota.WithDenyDirs(cfg.QuotaDenyDirs...))
+	}
+	if cfg.QuotaInheritOnlyThreshold > 0 {
+		quotaOpts = append(quotaOpts, quota.WithInheritOnlyThreshold(cfg.QuotaInheritOnlyThreshold))
+	}
+	quota.SetQuotaDriver(cfg.QuotaDriver, quotaOpts...)
+	if driver, ok := quota.GQuotaDriver.(*quota.PrjQuotaDriver); ok && len(cfg.QuotaMounts) > 0 {
+		// quota is still enabled lazily on the failed mounts.
+		if err := driver.EnableOnMounts(cfg.QuotaMounts); err != nil {
+			log.With(nil).Warnf("failed to enable quota on mounts: %v", err)
+		}
 	}
 
 	if err := checkLxcfsCfg(); err != nil {
@@ -246,6 +287,19 @@ func runDaemon(cmd *cobra.Command) error {
 		return fmt.Errorf("failed to new daemon")
 	}
 
+	// the container exceeding its quota polled by the fallback driver is stopped.
+	if cfg.QuotaPollingInterval > 0 {
+		pollingOpts := []quota.PollingOpt{quota.WithPollInterval(time.Duration(cfg.QuotaPollingInterval) * time.Second)}
+		for tool, p := range cfg.QuotaToolPaths {
+			pollingOpts = append(pollingOpts, quota.WithPollToolPath(tool, p))
+		}
+		quota.SetPollingFallback(quota.NewPollingQuotaDriver(func(dir string, usage *quota.QuotaUsage) {
+			if ctrMgr, ok := d.CtrMgr().(*mgr.ContainerManager); ok {
+				ctrMgr.StopOnQuotaExceeded(dir, usage)
+			}
+		}, pollingOpts...))
+	}
+
 	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGHUP)
 	sigHandles = append(sigHandles, d.Shutdown, d.ShutdownPlugin)
 
@@ -0,0 +1,78 @@
+// +build linux
+
+package quota
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// AuditSetQuota is the operation which sets the limit of a quota id.
+	AuditSetQuota = "set"
+
+	// AuditClearQuota is the operation which clears the limit of a quota id.
+	AuditClearQuota = "clear"
+)
+
+// auditActor is the process which makes the quota change, such as "pouchd[1234] uid=0".
+var auditActor = fmt.Sprintf("%s[%d] uid=%d", filepath.Base(os.Args[0]), os.Getpid(), os.Getuid())
+
+// AuditRecord defines a quota change made by quota driver.
+type AuditRecord struct {
+	// Operation is AuditSetQuota or AuditClearQuota.
+	Operation string
+
+	// Actor is the process which makes the change.
+	Actor string
+
+	// Dir is the directory which quota is set on, it is empty if the quota id
+	// is cleared on the whole mountpoint.
+	Dir        string
+	QuotaID    uint32
+	MountPoint string
+
+	// OldLimit and NewLimit are the block limits in bytes, OldLimit is read
+	// by repquota if it is not applied by driver, and 0 if it is unknown.
+	OldLimit uint64
+	NewLimit uint64
+
+	Time time.Time
+}
+
+// AuditSink receives the record of quota change, it is called only after the change succeeds.
+type AuditSink interface {
+	Audit(record AuditRecord)
+}
+
+// WithAuditSink sets the sink which quota changes are recorded in.
+func WithAuditSink(sink AuditSink) Opt {
+	return func(o *driverOpts) {
+		o.audit = sink
+	}
+}
+
+// audit sends the record to sink, it is a no-op if sink is nil.
+func audit(sink AuditSink, record AuditRecord) {
+	if sink == nil {
+		return
+	}
+	record.Actor = auditActor
+	record.Time = time.Now()
+	sink.Audit(record)
+}
+
+// auditOldLimit reads the block limit in bytes of quota id by repquota for the audit record,
+// it returns 0 if sink is nil, or the limit is unknown.
+func auditOldLimit(sink AuditSink, repquota, repquotaOpt string, quotaID uint32, mountPoint string) uint64 {
+	if sink == nil || quotaID == 0 {
+		return 0
+	}
+	usage, err := getQuotaUsage(repquota, repquotaOpt, quotaID, mountPoint)
+	if err != nil {
+		return 0
+	}
+	return usage.Limit
+}
@@ -0,0 +1,100 @@
+// +build linux
+
+package quota
+
+import (
+	"errors"
+	"testing"
+)
+
+// fakeAuditSink captures the audit records.
+type fakeAuditSink struct {
+	records []AuditRecord
+}
+
+func (s *fakeAuditSink) Audit(record AuditRecord) {
+	s.records = append(s.records, record)
+}
+
+func TestPrjQuotaAudit(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+
+	sink := &fakeAuditSink{}
+	driver := NewQuotaDriver("prjquota", WithAuditSink(sink)).(*PrjQuotaDriver)
+	driver.lastID = QuotaMinID
+	driver.journal = nil
+
+	first, err := driver.SetDiskQuotaWithResult(dir, "1m", 0)
+	if err != nil {
+		t.Fatalf("failed to set disk quota: %v", err)
+	}
+	if _, err := driver.SetDiskQuotaWithResult(dir, "2m", first.QuotaID); err != nil {
+		t.Fatalf("failed to set disk quota: %v", err)
+	}
+
+	// the failed change is not recorded.
+	runner.results["setquota"] = []fakeResult{{exit: 1, err: errors.New("exit status 1")}}
+	if _, err := driver.SetDiskQuotaWithResult(dir, "3m", first.QuotaID); err == nil {
+		t.Fatalf("expect error of failed setquota")
+	}
+
+	if len(sink.records) != 2 {
+		t.Fatalf("expect 2 audit records, got %v", sink.records)
+	}
+	for i, expect := range []AuditRecord{
+		{Operation: AuditSetQuota, Actor: auditActor, Dir: dir, QuotaID: first.QuotaID, MountPoint: first.MountPoint, NewLimit: 1024 * 1024},
+		{Operation: AuditSetQuota, Actor: auditActor, Dir: dir, QuotaID: first.QuotaID, MountPoint: first.MountPoint, OldLimit: 1024 * 1024, NewLimit: 2 * 1024 * 1024},
+	} {
+		got := sink.records[i]
+		if got.Time.IsZero() {
+			t.Fatalf("expect time of audit record %d", i)
+		}
+		got.Time = expect.Time
+		if got != expect {
+			t.Fatalf("expect audit record %v, got %v", expect, got)
+		}
+	}
+}
+
+func TestPrjQuotaAuditOldLimit(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+
+	origin := quotaIDCacheTTL
+	defer func() { quotaIDCacheTTL = origin }()
+	quotaIDCacheTTL = 0
+
+	sink := &fakeAuditSink{}
+	driver := &PrjQuotaDriver{
+		quotaIDs: make(map[uint32]struct{}),
+		lastID:   QuotaMinID,
+		audit:    sink,
+	}
+
+	// the quota id is set on directory before, such as by the daemon before restart.
+	runner.attrs[dir] = "16777217"
+	runner.results["repquota"] = []fakeResult{{stdout: "#16777217 --       4       0    1024              1     0     0\n"}}
+
+	result, err := driver.SetDiskQuotaWithResult(dir, "2m", 16777217)
+	if err != nil {
+		t.Fatalf("failed to set disk quota: %v", err)
+	}
+	if repquota := runner.executed("repquota"); len(repquota) != 1 || repquota[0][len(repquota[0])-1] != result.MountPoint {
+		t.Fatalf("expect old limit read by repquota on %s, got %v", result.MountPoint, repquota)
+	}
+
+	if len(sink.records) != 1 {
+		t.Fatalf("expect 1 audit record, got %v", sink.records)
+	}
+	got := sink.records[0]
+	if got.Actor != auditActor || got.OldLimit != 1024*1024 || got.NewLimit != 2*1024*1024 {
+		t.Fatalf("expect audit record by %s from 1m to 2m, got %+v", auditActor, got)
+	}
+}
@@ -0,0 +1,41 @@
+// +build linux
+
+package quota
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// fsGetXattr is the FS_IOC_FSGETXATTR ioctl request, _IOR('X', 31, struct fsxattr).
+const fsGetXattr = 0x801c581f
+
+// fsxattr is the struct fsxattr in linux/fs.h.
+type fsxattr struct {
+	xflags     uint32
+	extsize    uint32
+	nextents   uint32
+	projid     uint32
+	cowextsize uint32
+	pad        [8]byte
+}
+
+// getProjectID is used to get the project id of file, it is replaced in unit test.
+var getProjectID = ioctlGetProjectID
+
+// ioctlGetProjectID reads the project id of file by FS_IOC_FSGETXATTR ioctl,
+// which is supported by both ext4 and xfs, it avoids executing lsattr.
+func ioctlGetProjectID(file string) (uint32, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var attr fsxattr
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsGetXattr, uintptr(unsafe.Pointer(&attr))); errno != 0 {
+		return 0, errno
+	}
+	return attr.projid, nil
+}
@@ -0,0 +1,72 @@
+// +build linux
+
+package quota
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+)
+
+// newFsxattrTestDir creates a directory for test, skip the test if FS_IOC_FSGETXATTR is not supported.
+func newFsxattrTestDir(t testing.TB) (string, func()) {
+	dir, err := ioutil.TempDir("", "quota-fsxattr")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	if _, err := ioctlGetProjectID(dir); err == syscall.ENOTTY || err == syscall.EOPNOTSUPP || err == syscall.EINVAL {
+		os.RemoveAll(dir)
+		t.Skipf("FS_IOC_FSGETXATTR is not supported on %s: %v", dir, err)
+	}
+	return dir, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func Test_ioctlGetProjectID(t *testing.T) {
+	dir, clean := newFsxattrTestDir(t)
+	defer clean()
+
+	id, err := ioctlGetProjectID(dir)
+	if err != nil {
+		t.Fatalf("failed to get project id of %s: %v", dir, err)
+	}
+
+	// compare with lsattr if it is available.
+	if _, err := exec.LookPath("lsattr"); err != nil {
+		return
+	}
+	if got := (&PrjQuotaDriver{}).getQuotaIDByLsattr(dir); got != id {
+		t.Fatalf("expect project id %d by lsattr, got %d by ioctl", got, id)
+	}
+
+	if _, err := ioctlGetProjectID(dir + "-not-exist"); err == nil {
+		t.Fatalf("expect error for not existed file")
+	}
+}
+
+func BenchmarkGetQuotaIDIoctl(b *testing.B) {
+	dir, clean := newFsxattrTestDir(b)
+	defer clean()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := ioctlGetProjectID(dir); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetQuotaIDLsattr(b *testing.B) {
+	if _, err := exec.LookPath("lsattr"); err != nil {
+		b.Skip("lsattr is not found")
+	}
+	dir, clean := newFsxattrTestDir(b)
+	defer clean()
+
+	driver := &PrjQuotaDriver{}
+	for i := 0; i < b.N; i++ {
+		driver.getQuotaIDByLsattr(dir)
+	}
+}
@@ -12,7 +12,6 @@ import (
 	"sync"
 
 	"github.com/alibaba/pouch/pkg/bytefmt"
-	"github.com/alibaba/pouch/pkg/exec"
 	"github.com/alibaba/pouch/pkg/log"
 	"github.com/alibaba/pouch/pkg/system"
 
@@ -31,21 +30,36 @@ type GrpQuotaDriver struct {
 	// LastID is used to mark last used quota ID.
 	// quota ID is allocated increasingly by sequence one by one.
 	lastID uint32
+
+	// journal records the allocated quota ids in state dir.
+	journal *idJournal
+
+	// denyDirs saves the directories which quota is never applied on, besides the host root.
+	denyDirs []string
+
+	// tools saves the configured paths of quota tools.
+	tools toolPaths
+
+	// audit receives the record of quota change, nil means no audit.
+	audit AuditSink
 }
 
 // EnforceQuota is used to enforce disk quota effect on specified directory.
 func (quota *GrpQuotaDriver) EnforceQuota(dir string) (*MountInfo, error) {
-	log.With(nil).Debugf("start group quota driver: (%s)", dir)
+	log.WithFields(nil, map[string]interface{}{"dir": dir}).Debugf("start group quota driver")
 
 	devID, err := system.GetDevID(dir)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to get deivce id for directory: (%s)", dir)
+		return nil, errors.Wrapf(err, "failed to get device id for directory: (%s)", dir)
 	}
 
 	mountPoint, hasQuota, fsType := quota.CheckMountpoint(devID)
 	if mountPoint == "" {
 		return nil, fmt.Errorf("failed to find mountpoint: (%s)", dir)
 	}
+	if err := checkOverlayMount(dir, mountPoint, fsType); err != nil {
+		return nil, err
+	}
 
 	mountInfo := &MountInfo{
 		MountPoint: mountPoint,
@@ -55,10 +69,10 @@ func (quota *GrpQuotaDriver) EnforceQuota(dir string) (*MountInfo, error) {
 
 	if !hasQuota {
 		// remount option grpquota for mountpoint
-		exit, stdout, stderr, err := exec.Run(0, "mount", "-o", "remount,grpquota", mountPoint)
+		exit, stdout, stderr, err := execRun(0, quota.tools.path("mount"), "-o", "remount,grpquota", mountPoint)
 		if err != nil {
-			log.With(nil).Errorf("failed to remount grpquota, mountpoint: (%s), stdout: (%s), stderr: (%s), exit: (%d), err: (%v)",
-				mountPoint, stdout, stderr, exit, err)
+			log.WithFields(nil, map[string]interface{}{"dir": dir, "devID": devID, "fstype": fsType, "mountpoint": mountPoint}).
+				Errorf("failed to remount grpquota, stdout: (%s), stderr: (%s), exit: (%d), err: (%v)", stdout, stderr, exit, err)
 			return nil, errors.Wrapf(err, "failed to remount grpquota, mountpoint: (%s), stdout: (%s), stderr: (%s), exit: (%d)",
 				mountPoint, stdout, stderr, exit)
 		}
@@ -84,32 +98,33 @@ func (quota *GrpQuotaDriver) EnforceQuota(dir string) (*MountInfo, error) {
 			return nil, errors.Wrapf(writeErr, "failed to write file, filename: (%s), vfs version: (%s)",
 				filename, vfsVersion)
 		}
-		if exit, stdout, stderr, err := exec.Run(0, "setquota", "-g", "-t", "43200", "43200", mountPoint); err != nil {
+		if exit, stdout, stderr, err := execRun(0, quota.tools.path("setquota"), "-g", "-t", "43200", "43200", mountPoint); err != nil {
 			os.Remove(filename)
-			log.With(nil).Errorf("failed to setquota, stdout: (%s), stderr: (%s), exit: (%d), err: (%v)",
-				stdout, stderr, exit, err)
+			log.WithFields(nil, map[string]interface{}{"dir": dir, "devID": devID, "fstype": fsType, "mountpoint": mountPoint}).
+				Errorf("failed to setquota, stdout: (%s), stderr: (%s), exit: (%d), err: (%v)", stdout, stderr, exit, err)
 			return nil, errors.Wrapf(err, "failed to setquota, stdout: (%s), stderr: (%s), exit: (%d)",
 				stdout, stderr, exit)
 		}
 		if err := quota.setQuota(0, 0, mountPoint); err != nil {
 			os.Remove(filename)
-			log.With(nil).Errorf("failed to set quota, mountpoint: (%s), err: (%v)", mountPoint, err)
+			log.WithFields(nil, map[string]interface{}{"dir": dir, "devID": devID, "fstype": fsType, "mountpoint": mountPoint}).
+				Errorf("failed to set quota, err: (%v)", err)
 			return nil, errors.Wrapf(err, "failed to set quota, mountpoint: (%s)", mountPoint)
 		}
 	}
 
 	// check group quota status, on or not, pay attention, the right exit code of command 'quotaon' is '1'.
-	exit, stdout, stderr, err := exec.Run(0, "quotaon", "-pg", mountPoint)
+	exit, stdout, stderr, err := execRun(0, quota.tools.path("quotaon"), "-pg", mountPoint)
 	if err != nil && exit != 1 {
-		log.With(nil).Errorf("failed to quota on for mountpoint: (%s), exit: (%d), stdout: (%s), stderr: (%s), err: (%v)",
-			mountPoint, exit, stdout, stderr, err)
+		log.WithFields(nil, map[string]interface{}{"dir": dir, "devID": devID, "fstype": fsType, "mountpoint": mountPoint}).
+			Errorf("failed to quota on, exit: (%d), stdout: (%s), stderr: (%s), err: (%v)", exit, stdout, stderr, err)
 		return nil, errors.Wrapf(err, "failed to quota on for mountpoint: (%s), stdout: (%s), stderr: (%s), exit: (%d)",
 			mountPoint, stdout, stderr, exit)
 	}
 	if strings.Contains(stdout, " is on") {
 		return mountInfo, nil
 	}
-	if exit, stdout, stderr, err = exec.Run(0, "quotaon", mountPoint); err != nil {
+	if exit, stdout, stderr, err = execRun(0, quota.tools.path("quotaon"), mountPoint); err != nil {
 		mountPoint = ""
 		err = errors.Wrapf(err, "failed to quotaon, mountpoint: (%s), stdout: (%s), stderr: (%s), exit: (%d)",
 			mountPoint, stdout, stderr, exit)
@@ -133,96 +148,123 @@ func (quota *GrpQuotaDriver) EnforceQuota(dir string) (*MountInfo, error) {
 // cgroup /sys/fs/cgroup/memory cgroup rw,nosuid,nodev,noexec,relatime,memory 0 0
 // cgroup /sys/fs/cgroup/blkio cgroup rw,nosuid,nodev,noexec,relatime,blkio 0 0
 func (quota *GrpQuotaDriver) CheckMountpoint(devID uint64) (string, bool, string) {
-	log.With(nil).Debugf("check mountpoint, devID: %d", devID)
-	output, err := ioutil.ReadFile(procMountFile)
+	log.WithFields(nil, map[string]interface{}{"devID": devID}).Debugf("check mountpoint")
+	mount, err := findDeviceMount(devID)
 	if err != nil {
-		log.With(nil).Warnf("failed to read file: (%s), err: (%v)", procMountFile, err)
+		log.WithFields(nil, map[string]interface{}{"devID": devID}).
+			Warnf("failed to read file: (%s), err: (%v)", procMountFile, err)
+		return "", false, ""
+	}
+	if mount == nil {
 		return "", false, ""
 	}
 
-	var (
-		enableQuota bool
-		mountPoint  string
-		fsType      string
-	)
+	// get device's mountpoint and fs type.
+	mountPoint, fsType := mount.mountPoint, mount.fsType
 
 	// Two formats of group quota.
 	// /dev/sdb1 /home/pouch ext4 rw,relatime,prjquota,data=ordered 0 0
 	// /dev/sda1 /home/pouch ext4 rw,relatime,data=ordered,jqfmt=vfsv0,grpjquota=aquota.group 0 0
-	for _, line := range strings.Split(string(output), "\n") {
-		parts := strings.Split(line, " ")
-		if len(parts) != 6 {
-			continue
-		}
+	enableQuota := mount.hasOption("grpquota") || mount.hasOption("grpjquota")
 
-		devID2, _ := system.GetDevID(parts[1])
-		if devID != devID2 {
-			continue
-		}
+	log.WithFields(nil, map[string]interface{}{"devID": devID, "fstype": fsType, "mountpoint": mountPoint}).
+		Debugf("check device, enableQuota: (%v)", enableQuota)
 
-		// check the shortest mountpoint.
-		if mountPoint != "" && len(mountPoint) < len(parts[1]) {
-			continue
-		}
-
-		// get device's mountpoint and fs type.
-		mountPoint = parts[1]
-		fsType = parts[2]
+	return mountPoint, enableQuota, fsType
+}
 
-		// check the device turn on the grpquota or not.
-		if strings.Contains(parts[3], "grpquota") || strings.Contains(parts[3], "grpjquota") {
-			enableQuota = true
-		}
+// probeQuota checks whether group quota can be enforced on the directory, without the
+// side effect of EnforceQuota, such as remount. It is enforceable if the mount has group
+// quota option, or it is ext family, which EnforceQuota remounts with grpquota.
+func (quota *GrpQuotaDriver) probeQuota(dir string) error {
+	devID, err := system.GetDevID(dir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get device id for directory: (%s)", dir)
 	}
 
-	log.With(nil).Debugf("check device: (%d), mountpoint: (%s), enableQuota: (%v), fsType: (%s)",
-		devID, mountPoint, enableQuota, fsType)
-
-	return mountPoint, enableQuota, fsType
+	mountPoint, hasQuota, fsType := quota.CheckMountpoint(devID)
+	if mountPoint == "" {
+		return fmt.Errorf("failed to find mountpoint: (%s)", dir)
+	}
+	if err := checkOverlayMount(dir, mountPoint, fsType); err != nil {
+		return err
+	}
+	if !hasQuota && !isExtFs(fsType) {
+		return errors.Errorf("group quota is not enabled on %s mountpoint (%s)", fsType, mountPoint)
+	}
+	return nil
 }
 
 // SetDiskQuota is used to set quota for directory.
 func (quota *GrpQuotaDriver) SetDiskQuota(dir string, size string, quotaID uint32) error {
-	log.With(nil).Debugf("set disk quota, dir: %s, size: %s, quotaID: %d", dir, size, quotaID)
+	_, err := quota.SetDiskQuotaWithResult(dir, size, quotaID)
+	return err
+}
+
+// SetDiskQuotaWithResult works as SetDiskQuota, and returns the quota ID,
+// mountpoint and filesystem type which are actually used.
+func (quota *GrpQuotaDriver) SetDiskQuotaWithResult(dir string, size string, quotaID uint32) (*SetQuotaResult, error) {
+	log.WithFields(nil, map[string]interface{}{"dir": dir, "quotaID": quotaID}).Debugf("set disk quota, size: %s", size)
+
+	if err := checkQuotaDir(dir, quota.denyDirs); err != nil {
+		return nil, err
+	}
 
 	mountInfo, err := quota.EnforceQuota(dir)
 	if err != nil {
-		return errors.Wrapf(err, "failed to enforce quota, dir: (%s)", dir)
+		return nil, errors.Wrapf(err, "failed to enforce quota, dir: (%s)", dir)
 	}
 	if mountInfo == nil || mountInfo.MountPoint == "" {
-		return errors.Errorf("failed to find mountpoint, dir: (%s)", dir)
+		return nil, errors.Errorf("failed to find mountpoint, dir: (%s)", dir)
 	}
 
 	// transfer limit from kbyte to byte
 	limit, err := bytefmt.ToKilobytes(size)
 	if err != nil {
-		return errors.Wrapf(err, "failed to change size: (%s) to kilobytes", size)
+		return nil, errors.Wrapf(err, "failed to change size: (%s) to kilobytes", size)
 	}
 
-	if err := checkDevLimit(mountInfo, limit*1024); err != nil {
-		return err
+	if err := checkDevLimit(mountInfo, limit*1024, 0); err != nil {
+		return nil, err
 	}
 
+	oldLimit := auditOldLimit(quota.audit, quota.tools.path("repquota"), "-g", quota.GetQuotaIDInFileAttr(dir), mountInfo.MountPoint)
 	id, err := quota.setQuotaID(dir, quotaID)
 	if err != nil {
-		return errors.Wrapf(err, "failed to set subtree, dir: (%s), quota id: (%d)", dir, quotaID)
+		return nil, errors.Wrapf(err, "failed to set subtree, dir: (%s), quota id: (%d)", dir, quotaID)
 	}
 	if id == 0 {
-		return errors.Errorf("failed to find quota id to set subtree")
+		return nil, errors.Errorf("failed to find quota id to set subtree")
 	}
 
-	return quota.setQuota(id, limit, mountInfo.MountPoint)
+	if err := quota.setQuota(id, limit, mountInfo.MountPoint); err != nil {
+		return nil, err
+	}
+	audit(quota.audit, AuditRecord{
+		Operation:  AuditSetQuota,
+		Dir:        dir,
+		QuotaID:    id,
+		MountPoint: mountInfo.MountPoint,
+		OldLimit:   oldLimit,
+		NewLimit:   limit * 1024,
+	})
+
+	return &SetQuotaResult{
+		QuotaID:    id,
+		MountPoint: mountInfo.MountPoint,
+		FsType:     mountInfo.FsType,
+	}, nil
 }
 
 // GetQuotaIDInFileAttr returns quota ID in the directory attributes.
 // getfattr -n system.subtree --only-values --absolute-names /
 func (quota *GrpQuotaDriver) GetQuotaIDInFileAttr(dir string) uint32 {
-	log.With(nil).Debugf("get file attr, dir: %s", dir)
+	log.WithFields(nil, map[string]interface{}{"dir": dir}).Debugf("get file attr")
 
-	exit, stdout, stderr, err := exec.Run(0, "getfattr", "-n", "system.subtree", "--only-values", "--absolute-names", dir)
+	exit, stdout, stderr, err := execRun(0, quota.tools.path("getfattr"), "-n", "system.subtree", "--only-values", "--absolute-names", dir)
 	if err != nil {
-		log.With(nil).Errorf("failed to getfattr, dir: (%s), stdout: (%s), stderr: (%s), exit: (%d), err: (%s)",
-			dir, stdout, stderr, exit, err)
+		log.WithFields(nil, map[string]interface{}{"dir": dir}).
+			Errorf("failed to getfattr, stdout: (%s), stderr: (%s), exit: (%d), err: (%s)", stdout, stderr, exit, err)
 		return 0
 	}
 	v, _ := strconv.Atoi(stdout)
@@ -231,15 +273,15 @@ func (quota *GrpQuotaDriver) GetQuotaIDInFileAttr(dir string) uint32 {
 
 // SetQuotaIDInFileAttr is used to set quota ID in file attributes.
 func (quota *GrpQuotaDriver) SetQuotaIDInFileAttr(dir string, id uint32) error {
-	log.With(nil).Debugf("set file attr, dir: %s, quotaID: %d", dir, id)
+	log.WithFields(nil, map[string]interface{}{"dir": dir, "quotaID": id}).Debugf("set file attr")
 
 	if isRegular, err := CheckRegularFile(dir); err != nil || !isRegular {
-		log.With(nil).Debugf("set quota id skip not regular file: %s", dir)
+		log.WithFields(nil, map[string]interface{}{"dir": dir}).Debugf("set quota id skip not regular file")
 		return err
 	}
 
 	strid := strconv.FormatUint(uint64(id), 10)
-	exit, stdout, stderr, err := exec.Run(0, "setfattr", "-n", "system.subtree", "-v", strid, dir)
+	exit, stdout, stderr, err := execRun(0, quota.tools.path("setfattr"), "-n", "system.subtree", "-v", strid, dir)
 	return errors.Wrapf(err, "failed to setfattr, dir: (%s), quota id: (%d), stdout: (%s), stderr: (%s), exit: (%d)",
 		dir, id, stdout, stderr, exit)
 }
@@ -247,15 +289,15 @@ func (quota *GrpQuotaDriver) SetQuotaIDInFileAttr(dir string, id uint32) error {
 // SetQuotaIDInFileAttrNoOutput is used to set file attributes without error.
 func (quota *GrpQuotaDriver) setQuotaIDInFileAttrNoOutput(dir string, quotaID uint32) {
 	if isRegular, err := CheckRegularFile(dir); err != nil || !isRegular {
-		log.With(nil).Debugf("set quota id skip not regular file: %s", dir)
+		log.WithFields(nil, map[string]interface{}{"dir": dir}).Debugf("set quota id skip not regular file")
 		return
 	}
 
 	strid := strconv.FormatUint(uint64(quotaID), 10)
-	exit, stdout, stderr, err := exec.Run(0, "setfattr", "-n", "system.subtree", "-v", strid, dir)
+	exit, stdout, stderr, err := execRun(0, quota.tools.path("setfattr"), "-n", "system.subtree", "-v", strid, dir)
 	if err != nil {
-		log.With(nil).Errorf("failed to setfattr, dir: (%s), quota id: (%d), stdout: (%s), stderr: (%s), exit: (%d), err: (%v)",
-			dir, quotaID, stdout, stderr, exit, err)
+		log.WithFields(nil, map[string]interface{}{"dir": dir, "quotaID": quotaID}).
+			Errorf("failed to setfattr, stdout: (%s), stderr: (%s), exit: (%d), err: (%v)", stdout, stderr, exit, err)
 	}
 }
 
@@ -266,10 +308,11 @@ func (quota *GrpQuotaDriver) GetNextQuotaID() (uint32, error) {
 
 	if quota.lastID == 0 {
 		var err error
-		quota.quotaIDs, quota.lastID, err = loadQuotaIDs("-gan")
+		quota.quotaIDs, quota.lastID, err = loadQuotaIDs(quota.tools.path("repquota"), "-gan")
 		if err != nil {
 			return 0, errors.Wrap(err, "failed to load quota list")
 		}
+		quota.lastID = quota.journal.merge(quota.quotaIDs, quota.lastID)
 	}
 	id := quota.lastID
 	for {
@@ -283,44 +326,80 @@ func (quota *GrpQuotaDriver) GetNextQuotaID() (uint32, error) {
 	}
 	quota.quotaIDs[id] = struct{}{}
 	quota.lastID = id
+	if err := quota.journal.record(id); err != nil {
+		log.WithFields(nil, map[string]interface{}{"quotaID": id}).Warnf("failed to record quota id in journal, err(%v)", err)
+	}
 
-	log.With(nil).Debugf("get next project quota id: %d", id)
+	log.WithFields(nil, map[string]interface{}{"quotaID": id}).Debugf("get next group quota id")
 	return id, nil
 }
 
+// releaseDirQuota clears the limit of the quota id of directory, and releases the
+// quota id, it is called before the directory is removed.
+func (quota *GrpQuotaDriver) releaseDirQuota(dir string) error {
+	quotaID := quota.GetQuotaIDInFileAttr(dir)
+	if quotaID == 0 {
+		return errors.Errorf("no quota id set on dir(%s)", dir)
+	}
+	devID, err := system.GetDevID(dir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get device id for directory: (%s)", dir)
+	}
+	mountPoint, _, _ := quota.CheckMountpoint(devID)
+	if mountPoint == "" {
+		return errors.Errorf("mountPoint not found for the device on which dir (%s) lies", dir)
+	}
+
+	oldLimit := auditOldLimit(quota.audit, quota.tools.path("repquota"), "-g", quotaID, mountPoint)
+	if err := quota.setQuota(quotaID, 0, mountPoint); err != nil {
+		return errors.Wrapf(err, "failed to clear quota of dir(%s)", dir)
+	}
+	audit(quota.audit, AuditRecord{
+		Operation:  AuditClearQuota,
+		Dir:        dir,
+		QuotaID:    quotaID,
+		MountPoint: mountPoint,
+		OldLimit:   oldLimit,
+	})
+
+	quota.releaseQuotaID(dir, quotaID)
+	return nil
+}
+
+// releaseQuotaID returns the quota id allocated for directory to the free ones,
+// so that it could be allocated again. The caller should have cleared its limit.
+func (quota *GrpQuotaDriver) releaseQuotaID(dir string, id uint32) {
+	quota.lock.Lock()
+	delete(quota.quotaIDs, id)
+	quota.lock.Unlock()
+
+	if err := quota.journal.release(id); err != nil {
+		log.WithFields(nil, map[string]interface{}{"dir": dir, "quotaID": id}).Warnf("failed to release quota id in journal, err(%v)", err)
+	}
+}
+
 func getVFSVersionAndQuotaFile(devID uint64) (string, string, error) {
-	output, err := ioutil.ReadFile(procMountFile)
+	mounts, err := readMounts()
 	if err != nil {
-		log.With(nil).Warnf("failed to read file: (%s), err: (%v)", procMountFile, err)
+		log.WithFields(nil, map[string]interface{}{"devID": devID}).
+			Warnf("failed to read file: (%s), err: (%v)", procMountFile, err)
 		return "", "", errors.Wrap(err, "failed to read /proc/mounts")
 	}
 
 	vfsVersion := "vfsv0"
 	quotaFilename := "aquota.group"
-	for _, line := range strings.Split(string(output), "\n") {
-		// TODO: add an example here to make following code readable.
-		// /dev/sdb1 /home/pouch ext4 rw,relatime,prjquota,data=ordered 0 0 ?
-		parts := strings.Split(line, " ")
-		if len(parts) != 6 {
-			continue
-		}
-
-		devID2, _ := system.GetDevID(parts[1])
+	// /dev/sda1 /home/pouch ext4 rw,relatime,data=ordered,jqfmt=vfsv0,grpjquota=aquota.group 0 0
+	for _, m := range mounts {
+		devID2, _ := mountDevID(m.mountPoint)
 		if devID != devID2 {
 			continue
 		}
 
-		for _, opt := range strings.Split(parts[3], ",") {
-			items := strings.SplitN(opt, "=", 2)
-			if len(items) != 2 {
-				continue
-			}
-			switch items[0] {
-			case "jqfmt":
-				vfsVersion = items[1]
-			case "grpjquota":
-				quotaFilename = items[1]
-			}
+		if v, ok := m.option("jqfmt"); ok {
+			vfsVersion = v
+		}
+		if v, ok := m.option("grpjquota"); ok {
+			quotaFilename = v
 		}
 		return vfsVersion, quotaFilename, nil
 	}
@@ -332,7 +411,7 @@ func getVFSVersionAndQuotaFile(devID uint64) (string, string, error) {
 func (quota *GrpQuotaDriver) SetFileAttrRecursive(dir string, quotaID uint32) error {
 	return filepath.Walk(dir, func(path string, fd os.FileInfo, err error) error {
 		if err != nil {
-			log.With(nil).Warnf("setQuota walk dir %s get error %v", path, err)
+			log.WithFields(nil, map[string]interface{}{"dir": path, "quotaID": quotaID}).Warnf("setQuota walk dir get error %v", err)
 			return nil
 		}
 
@@ -344,13 +423,33 @@ func (quota *GrpQuotaDriver) SetFileAttrRecursive(dir string, quotaID uint32) er
 	})
 }
 
+// GetDiskQuota returns the disk usage and limit of the quota id of directory,
+// the usage is read by `repquota -g -n $mountpoint`.
+func (quota *GrpQuotaDriver) GetDiskQuota(dir string) (*QuotaUsage, error) {
+	quotaID := quota.GetQuotaIDInFileAttr(dir)
+	if quotaID == 0 {
+		return nil, errors.Errorf("no quota id set on dir(%s)", dir)
+	}
+
+	devID, err := getDevID(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get device id for directory: (%s)", dir)
+	}
+	mountPoint, _, _ := quota.CheckMountpoint(devID)
+	if mountPoint == "" {
+		return nil, errors.Errorf("mountPoint not found for the device on which dir (%s) lies", dir)
+	}
+
+	return getQuotaUsage(quota.tools.path("repquota"), "-g", quotaID, mountPoint)
+}
+
 // setQuotaID is used to set quota id for directory,
 // setfattr -n system.subtree -v $QUOTAID
 func (quota *GrpQuotaDriver) setQuotaID(dir string, qid uint32) (uint32, error) {
-	log.With(nil).Debugf("set subtree, dir: %s, quotaID: %d", dir, qid)
+	log.WithFields(nil, map[string]interface{}{"dir": dir, "quotaID": qid}).Debugf("set subtree")
 
 	if isRegular, err := CheckRegularFile(dir); err != nil || !isRegular {
-		log.With(nil).Debugf("set quota id skip not regular file: %s", dir)
+		log.WithFields(nil, map[string]interface{}{"dir": dir}).Debugf("set quota id skip not regular file")
 		return 0, errors.Errorf("file(%s) is not regular file", dir)
 	}
 
@@ -368,19 +467,20 @@ func (quota *GrpQuotaDriver) setQuotaID(dir string, qid uint32) (uint32, error)
 		return 0, errors.Wrapf(err, "failed to get file: (%s) quota id", dir)
 	}
 	strid := strconv.FormatUint(uint64(id), 10)
-	exit, stdout, stderr, err := exec.Run(0, "setfattr", "-n", "system.subtree", "-v", strid, dir)
+	exit, stdout, stderr, err := execRun(0, quota.tools.path("setfattr"), "-n", "system.subtree", "-v", strid, dir)
 
 	return id, errors.Wrapf(err, "failed to setfattr, dir: (%s), quota id: (%s), stdout: (%s), stderr: (%s), exit: (%d)",
 		dir, strid, stdout, stderr, exit)
 }
 
 func (quota *GrpQuotaDriver) setQuota(quotaID uint32, diskQuota uint64, mountPoint string) error {
-	log.With(nil).Debugf("set user quota, quotaID: %d, limit: %d, mountpoint: %s", quotaID, diskQuota, mountPoint)
+	log.WithFields(nil, map[string]interface{}{"quotaID": quotaID, "mountpoint": mountPoint}).
+		Debugf("set group quota, limit: %d", diskQuota)
 
 	quotaIDStr := strconv.FormatUint(uint64(quotaID), 10)
 	limit := strconv.FormatUint(diskQuota, 10)
 
-	exit, stdout, stderr, err := exec.Run(0, "setquota", "-g", quotaIDStr, "0", limit, "0", "0", mountPoint)
+	exit, stdout, stderr, err := execRun(0, quota.tools.path("setquota"), "-g", quotaIDStr, "0", limit, "0", "0", mountPoint)
 	return errors.Wrapf(err, "failed to set quota, mountpoint: (%s), quota id: (%d), quota: (%d kbytes), stdout: (%s), stderr: (%s), exit: (%d)",
 		mountPoint, quotaID, diskQuota, stdout, stderr, exit)
 }
@@ -0,0 +1,68 @@
+// +build linux
+
+package quota
+
+import (
+	"strings"
+	"time"
+)
+
+// quotaIDCacheTTL is how long the quota id read from file attr is cached,
+// it is replaced in unit test.
+var quotaIDCacheTTL = 3 * time.Second
+
+// cachedQuotaID represents the quota id of directory read from file attr.
+type cachedQuotaID struct {
+	id     uint32
+	expire time.Time
+}
+
+// getCachedQuotaID returns the cached quota id of directory if it does not expire.
+func (quota *PrjQuotaDriver) getCachedQuotaID(dir string) (uint32, bool) {
+	quota.idCacheLock.Lock()
+	defer quota.idCacheLock.Unlock()
+
+	cached, ok := quota.idCache[dir]
+	if !ok {
+		return 0, false
+	}
+	if time.Now().After(cached.expire) {
+		delete(quota.idCache, dir)
+		return 0, false
+	}
+	return cached.id, true
+}
+
+// cacheQuotaID caches the quota id of directory, 0 is not cached since it
+// also means failure to read the file attr.
+func (quota *PrjQuotaDriver) cacheQuotaID(dir string, id uint32) {
+	if id == 0 || quotaIDCacheTTL <= 0 {
+		return
+	}
+
+	quota.idCacheLock.Lock()
+	defer quota.idCacheLock.Unlock()
+
+	if quota.idCache == nil {
+		quota.idCache = make(map[string]cachedQuotaID)
+	}
+	quota.idCache[dir] = cachedQuotaID{id: id, expire: time.Now().Add(quotaIDCacheTTL)}
+}
+
+// invalidateQuotaID drops the cached quota id of directory, and of all the files
+// under it if recursive is true. It is called whenever driver changes the file attr.
+func (quota *PrjQuotaDriver) invalidateQuotaID(dir string, recursive bool) {
+	quota.idCacheLock.Lock()
+	defer quota.idCacheLock.Unlock()
+
+	delete(quota.idCache, dir)
+	if !recursive {
+		return
+	}
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	for d := range quota.idCache {
+		if strings.HasPrefix(d, prefix) {
+			delete(quota.idCache, d)
+		}
+	}
+}
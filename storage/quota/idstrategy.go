@@ -0,0 +1,56 @@
+// +build linux
+
+package quota
+
+import (
+	"math"
+)
+
+// IDStrategy decides the order in which quota ids are allocated.
+type IDStrategy interface {
+	// Next returns the candidate quota id after last, which is the last candidate
+	// returned or the max quota id in use when driver starts.
+	// It returns false if no more quota id could be allocated.
+	Next(last uint32) (uint32, bool)
+}
+
+// WithIDStrategy sets the strategy of quota id allocation, the default one allocates
+// quota ids after QuotaMinID one by one. It is only used by project quota driver.
+func WithIDStrategy(strategy IDStrategy) Opt {
+	return func(o *driverOpts) {
+		o.idStrategy = strategy
+	}
+}
+
+// sequentialStrategy allocates quota ids after QuotaMinID one by one.
+type sequentialStrategy struct{}
+
+// Next implements IDStrategy.
+func (sequentialStrategy) Next(last uint32) (uint32, bool) {
+	if last < QuotaMinID {
+		last = QuotaMinID
+	}
+	if last == math.MaxUint32 {
+		return 0, false
+	}
+	return last + 1, true
+}
+
+// RangeStrategy allocates quota ids in [Min, Max] one by one, it is used to
+// cluster the quota ids, such as giving each tenant its own range.
+type RangeStrategy struct {
+	Min uint32
+	Max uint32
+}
+
+// Next implements IDStrategy.
+func (r RangeStrategy) Next(last uint32) (uint32, bool) {
+	// last is out of range when it is the quota id in use of others.
+	if last < r.Min || last > r.Max {
+		return r.Min, r.Min <= r.Max
+	}
+	if last == r.Max {
+		return 0, false
+	}
+	return last + 1, true
+}
@@ -0,0 +1,189 @@
+// +build linux
+
+package quota
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/alibaba/pouch/pkg/log"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultStateDir is the default directory to store quota state,
+	// it lies in the default home dir of pouchd.
+	DefaultStateDir = "/var/lib/pouch/quota"
+
+	// idJournalFile is the file name of quota id journal in state dir.
+	idJournalFile = "quota-ids"
+)
+
+// idJournal records the allocated quota ids into a file in state dir, so that the ids
+// which have been allocated but not been set into quota tables yet will not be
+// allocated again after pouchd restarts.
+//
+// Each line holds an allocated quota id, or a released one prefixed with "-", such as
+// the id reclaimed by GarbageCollectIDs. The journal is compacted into the ids still
+// allocated when it is loaded, so it does not grow without bound.
+//
+// The state dir is created with mode 0700 and the journal with mode 0600,
+// since only root should read or change quota state.
+type idJournal struct {
+	lock     sync.Mutex
+	stateDir string
+}
+
+func newIDJournal(stateDir string) *idJournal {
+	if stateDir == "" {
+		stateDir = DefaultStateDir
+	}
+	return &idJournal{stateDir: stateDir}
+}
+
+func (j *idJournal) path() string {
+	return filepath.Join(j.stateDir, idJournalFile)
+}
+
+// record appends the allocated quota id into journal.
+func (j *idJournal) record(id uint32) error {
+	if j == nil {
+		return nil
+	}
+	return j.append(fmt.Sprintf("%d\n", id))
+}
+
+// release appends the released quota ids into journal, they are dropped from
+// the allocated ones when journal is loaded.
+func (j *idJournal) release(ids ...uint32) error {
+	if j == nil || len(ids) == 0 {
+		return nil
+	}
+
+	var b strings.Builder
+	for _, id := range ids {
+		fmt.Fprintf(&b, "-%d\n", id)
+	}
+	return j.append(b.String())
+}
+
+// append writes the lines at the end of journal.
+func (j *idJournal) append(lines string) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if err := os.MkdirAll(j.stateDir, 0700); err != nil {
+		return errors.Wrapf(err, "failed to create quota state dir(%s)", j.stateDir)
+	}
+
+	f, err := os.OpenFile(j.path(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open quota id journal(%s)", j.path())
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(lines); err != nil {
+		return errors.Wrapf(err, "failed to write quota id journal(%s)", j.path())
+	}
+	return nil
+}
+
+// load returns the quota ids which are allocated and not released in journal,
+// and compacts the journal into them if any line is dropped.
+func (j *idJournal) load() (map[uint32]struct{}, error) {
+	ids := make(map[uint32]struct{})
+	if j == nil {
+		return ids, nil
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	f, err := os.Open(j.path())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ids, nil
+		}
+		return nil, errors.Wrapf(err, "failed to open quota id journal(%s)", j.path())
+	}
+	defer f.Close()
+
+	var lines int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines++
+		line := strings.TrimSpace(scanner.Text())
+		released := strings.HasPrefix(line, "-")
+		id, err := strconv.ParseUint(strings.TrimPrefix(line, "-"), 10, 32)
+		if err != nil {
+			continue
+		}
+		if released {
+			delete(ids, uint32(id))
+		} else {
+			ids[uint32(id)] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to read quota id journal(%s)", j.path())
+	}
+
+	if lines > len(ids) {
+		if err := j.compact(ids); err != nil {
+			log.WithFields(nil, map[string]interface{}{"dir": j.stateDir}).Warnf("failed to compact quota id journal, err(%v)", err)
+		}
+	}
+	return ids, nil
+}
+
+// compact rewrites journal with the allocated quota ids, the new journal is written
+// into a temporary file and renamed, so that it is never left half written.
+// It must be called with lock held.
+func (j *idJournal) compact(ids map[uint32]struct{}) error {
+	sorted := make([]uint32, 0, len(ids))
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Slice(sorted, func(i, k int) bool { return sorted[i] < sorted[k] })
+
+	var b strings.Builder
+	for _, id := range sorted {
+		fmt.Fprintf(&b, "%d\n", id)
+	}
+
+	tmp := j.path() + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(b.String()), 0600); err != nil {
+		return errors.Wrapf(err, "failed to write quota id journal(%s)", tmp)
+	}
+	if err := os.Rename(tmp, j.path()); err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "failed to replace quota id journal(%s)", j.path())
+	}
+	return nil
+}
+
+// merge adds the quota ids recorded in journal into quotaIDs,
+// and returns the max one of lastID and the recorded ids.
+func (j *idJournal) merge(quotaIDs map[uint32]struct{}, lastID uint32) uint32 {
+	ids, err := j.load()
+	if err != nil {
+		log.WithFields(nil, map[string]interface{}{"dir": j.stateDir}).Warnf("failed to load quota id journal, err(%v)", err)
+		return lastID
+	}
+
+	for id := range ids {
+		quotaIDs[id] = struct{}{}
+		if id > lastID {
+			lastID = id
+		}
+	}
+	return lastID
+}
@@ -0,0 +1,98 @@
+// +build linux
+
+package quota
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQuotaIDJournalInStateDir(t *testing.T) {
+	_, restore := newFakeRunner()
+	defer restore()
+
+	root, err := ioutil.TempDir("", "quota-state")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	stateDir := filepath.Join(root, "quota")
+
+	driver := NewQuotaDriver("prjquota", WithStateDir(stateDir))
+	id, err := driver.GetNextQuotaID()
+	if err != nil {
+		t.Fatalf("failed to get next quota id: %v", err)
+	}
+
+	fi, err := os.Stat(stateDir)
+	if err != nil {
+		t.Fatalf("expect state dir to be created: %v", err)
+	}
+	if fi.Mode().Perm() != 0700 {
+		t.Fatalf("expect state dir mode 0700, got %v", fi.Mode().Perm())
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(stateDir, idJournalFile))
+	if err != nil {
+		t.Fatalf("failed to read quota id journal: %v", err)
+	}
+	if strings.TrimSpace(string(data)) != "16777217" || id != QuotaMinID+1 {
+		t.Fatalf("expect quota id %d recorded, got id %d, journal %q", QuotaMinID+1, id, data)
+	}
+
+	// a new driver on the same state dir never allocates the recorded id again.
+	driver = NewQuotaDriver("prjquota", WithStateDir(stateDir))
+	next, err := driver.GetNextQuotaID()
+	if err != nil {
+		t.Fatalf("failed to get next quota id: %v", err)
+	}
+	if next != id+1 {
+		t.Fatalf("expect quota id %d, got %d", id+1, next)
+	}
+}
+
+func TestQuotaIDJournalRelease(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "quota-state")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(stateDir)
+
+	j := newIDJournal(stateDir)
+	for _, id := range []uint32{QuotaMinID + 1, QuotaMinID + 2, QuotaMinID + 3} {
+		if err := j.record(id); err != nil {
+			t.Fatalf("failed to record quota id: %v", err)
+		}
+	}
+	if err := j.release(QuotaMinID+2, QuotaMinID+3); err != nil {
+		t.Fatalf("failed to release quota ids: %v", err)
+	}
+	// the released id is recorded again after being allocated again.
+	if err := j.record(QuotaMinID + 3); err != nil {
+		t.Fatalf("failed to record quota id: %v", err)
+	}
+
+	quotaIDs := make(map[uint32]struct{})
+	lastID := j.merge(quotaIDs, QuotaMinID)
+	if len(quotaIDs) != 2 || lastID != QuotaMinID+3 {
+		t.Fatalf("expect quota ids [%d %d] loaded, got %v, last id %d", QuotaMinID+1, QuotaMinID+3, quotaIDs, lastID)
+	}
+	if _, ok := quotaIDs[QuotaMinID+2]; ok {
+		t.Fatalf("expect released quota id %d not loaded", QuotaMinID+2)
+	}
+
+	// the journal is compacted into the allocated ids on load.
+	data, err := ioutil.ReadFile(filepath.Join(stateDir, idJournalFile))
+	if err != nil {
+		t.Fatalf("failed to read quota id journal: %v", err)
+	}
+	if string(data) != "16777217\n16777219\n" {
+		t.Fatalf("expect journal compacted, got %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, idJournalFile+".tmp")); !os.IsNotExist(err) {
+		t.Fatalf("expect no temporary journal left, got %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+// +build linux
+
+package quota
+
+import (
+	"sync"
+	"time"
+
+	"github.com/alibaba/pouch/pkg/log"
+)
+
+const (
+	// defaultMonitorInterval is the default interval to sample the quota usage.
+	defaultMonitorInterval = time.Minute
+
+	// defaultMonitorThreshold is the default usage percentage of limit to fire the callback.
+	defaultMonitorThreshold = 90
+)
+
+// ThresholdFunc is called when the quota usage of directory crosses the threshold.
+type ThresholdFunc func(dir string, usage *QuotaUsage)
+
+// UsageMonitor samples the quota usage of the tracked directories periodically,
+// and calls the ThresholdFunc when the usage crosses the percentage of limit.
+// The callback is fired once when crossing, and fired again only after the usage
+// falls below the threshold and crosses it again.
+type UsageMonitor struct {
+	interval  time.Duration
+	threshold uint64
+	callback  ThresholdFunc
+
+	// getUsage is used to get the quota usage of directory, it is replaced in unit test.
+	getUsage func(dir string) (*QuotaUsage, error)
+
+	// lock protects dirs.
+	lock sync.Mutex
+	// dirs saves the tracked directories.
+	// key: directory, value: whether the usage is over threshold.
+	dirs map[string]bool
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+// MonitorOpt is used to modify the usage monitor setting.
+type MonitorOpt func(*UsageMonitor)
+
+// WithMonitorInterval sets the interval to sample the quota usage.
+func WithMonitorInterval(interval time.Duration) MonitorOpt {
+	return func(m *UsageMonitor) {
+		if interval > 0 {
+			m.interval = interval
+		}
+	}
+}
+
+// WithMonitorThreshold sets the usage percentage of limit to fire the callback.
+func WithMonitorThreshold(percent uint64) MonitorOpt {
+	return func(m *UsageMonitor) {
+		if percent > 0 && percent <= 100 {
+			m.threshold = percent
+		}
+	}
+}
+
+// NewUsageMonitor returns a usage monitor which calls callback when usage crosses threshold.
+func NewUsageMonitor(callback ThresholdFunc, opts ...MonitorOpt) *UsageMonitor {
+	m := &UsageMonitor{
+		interval:  defaultMonitorInterval,
+		threshold: defaultMonitorThreshold,
+		callback:  callback,
+		getUsage:  GetDiskQuota,
+		dirs:      make(map[string]bool),
+		stopCh:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Add starts to track the quota usage of directory.
+func (m *UsageMonitor) Add(dir string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.dirs[dir]; !ok {
+		m.dirs[dir] = false
+	}
+}
+
+// Remove stops tracking the quota usage of directory.
+func (m *UsageMonitor) Remove(dir string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.dirs, dir)
+}
+
+// Start samples the quota usage periodically in background until Stop is called.
+func (m *UsageMonitor) Start() {
+	go func() {
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				m.check()
+			case <-m.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops sampling the quota usage.
+func (m *UsageMonitor) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stopCh)
+	})
+}
+
+// check samples the quota usage of tracked directories once.
+func (m *UsageMonitor) check() {
+	m.lock.Lock()
+	dirs := make([]string, 0, len(m.dirs))
+	for dir := range m.dirs {
+		dirs = append(dirs, dir)
+	}
+	m.lock.Unlock()
+
+	for _, dir := range dirs {
+		usage, err := m.getUsage(dir)
+		if err != nil {
+			log.WithFields(nil, map[string]interface{}{"dir": dir}).Warnf("failed to get quota usage, err: (%v)", err)
+			continue
+		}
+		if usage.Limit == 0 {
+			continue
+		}
+
+		over := usage.Used*100 >= usage.Limit*m.threshold
+
+		m.lock.Lock()
+		was, ok := m.dirs[dir]
+		if ok {
+			m.dirs[dir] = over
+		}
+		m.lock.Unlock()
+
+		if ok && over && !was && m.callback != nil {
+			log.WithFields(nil, map[string]interface{}{"dir": dir, "quotaID": usage.QuotaID}).
+				Warnf("quota usage crosses threshold, used: (%d bytes), limit: (%d bytes), threshold: (%d%%)",
+					usage.Used, usage.Limit, m.threshold)
+			m.callback(dir, usage)
+		}
+	}
+}
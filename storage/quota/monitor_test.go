@@ -0,0 +1,42 @@
+// +build linux
+
+package quota
+
+import (
+	"testing"
+)
+
+func TestUsageMonitorThreshold(t *testing.T) {
+	var fired []uint64
+	m := NewUsageMonitor(func(dir string, usage *QuotaUsage) {
+		if dir != "/foo" {
+			t.Fatalf("expect callback of /foo, got %s", dir)
+		}
+		fired = append(fired, usage.Used)
+	}, WithMonitorThreshold(80))
+
+	var used uint64
+	m.getUsage = func(dir string) (*QuotaUsage, error) {
+		return &QuotaUsage{QuotaID: 16777217, Used: used, Limit: 100}, nil
+	}
+	m.Add("/foo")
+
+	for _, u := range []uint64{10, 79, 80, 95, 50, 85} {
+		used = u
+		m.check()
+	}
+
+	// fired when crossing 80, and again after falling below and crossing again.
+	if len(fired) != 2 || fired[0] != 80 || fired[1] != 85 {
+		t.Fatalf("expect callback fired at usage [80 85], got %v", fired)
+	}
+
+	m.Remove("/foo")
+	used = 10
+	m.check()
+	used = 90
+	m.check()
+	if len(fired) != 2 {
+		t.Fatalf("expect no callback for removed dir, got %v", fired)
+	}
+}
@@ -0,0 +1,103 @@
+// +build linux
+
+package quota
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// mountinfo represents an entry of /proc/mounts, such as:
+//
+// /dev/sdb1 /home/pouch ext4 rw,relatime,prjquota,data=ordered 0 0
+type mountinfo struct {
+	device     string
+	mountPoint string
+	fsType     string
+	options    []string
+}
+
+// hasOption returns whether the mount option is set, the option with value,
+// such as "size=1024k", is matched by its name.
+func (m *mountinfo) hasOption(name string) bool {
+	_, ok := m.option(name)
+	return ok
+}
+
+// option returns the value of mount option, the value is empty if the option has no value.
+func (m *mountinfo) option(name string) (string, bool) {
+	for _, opt := range m.options {
+		items := strings.SplitN(opt, "=", 2)
+		if items[0] != name {
+			continue
+		}
+		if len(items) == 2 {
+			return items[1], true
+		}
+		return "", true
+	}
+	return "", false
+}
+
+// findTopMount returns the entry mounted on the mountpoint, the later one is on top
+// if the mountpoint is mounted more than once. It returns nil if no entry is found.
+func findTopMount(mounts []*mountinfo, mountPoint string) *mountinfo {
+	var top *mountinfo
+	for _, m := range mounts {
+		if m.mountPoint == mountPoint {
+			top = m
+		}
+	}
+	return top
+}
+
+// readMounts reads and parses the mounts file, the caller should read it once
+// and reuse the entries within one operation.
+func readMounts() ([]*mountinfo, error) {
+	data, err := ioutil.ReadFile(procMountFile)
+	if err != nil {
+		return nil, err
+	}
+	return parseMounts(string(data)), nil
+}
+
+// parseMounts parses the content of mounts file, the malformed line is skipped.
+// The fields are separated by whitespace, and the whitespace and backslash in
+// the device and mountpoint are escaped as octal, such as "\040" for space.
+func parseMounts(data string) []*mountinfo {
+	var mounts []*mountinfo
+	for _, line := range strings.Split(data, "\n") {
+		parts := strings.Fields(line)
+		if len(parts) != 6 {
+			continue
+		}
+		mounts = append(mounts, &mountinfo{
+			device:     unescapeMountField(parts[0]),
+			mountPoint: unescapeMountField(parts[1]),
+			fsType:     parts[2],
+			options:    strings.Split(parts[3], ","),
+		})
+	}
+	return mounts
+}
+
+// unescapeMountField converts the octal escape sequences, such as "\040", in the field.
+func unescapeMountField(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,84 @@
+// +build linux
+
+package quota
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_parseMounts(t *testing.T) {
+	fixture := `/dev/sda1 / ext4 rw,relatime,data=ordered 0 0
+proc /proc proc rw,nosuid,nodev,noexec,relatime 0 0
+tmpfs /dev/shm tmpfs rw,nosuid,nodev,size=65536k 0 0
+/dev/sdb1 /home/pouch ext4 rw,relatime,prjquota,data=ordered 0 0
+/dev/sdc1 /mnt/my\040data xfs rw,relatime,attr2,inode64,prjquota 0 0
+/dev/sdd1 /mnt/back\134slash ext4 rw,relatime,data=ordered,jqfmt=vfsv0,grpjquota=aquota.group 0 0
+overlay /var/lib/pouch/rootfs overlay rw,relatime,lowerdir=/l1:/l2,upperdir=/u,workdir=/w 0 0
+malformed line
+
+/dev/sde1 /bad ext4
+`
+	mounts := parseMounts(fixture)
+
+	expected := []mountinfo{
+		{"/dev/sda1", "/", "ext4", []string{"rw", "relatime", "data=ordered"}},
+		{"proc", "/proc", "proc", []string{"rw", "nosuid", "nodev", "noexec", "relatime"}},
+		{"tmpfs", "/dev/shm", "tmpfs", []string{"rw", "nosuid", "nodev", "size=65536k"}},
+		{"/dev/sdb1", "/home/pouch", "ext4", []string{"rw", "relatime", "prjquota", "data=ordered"}},
+		{"/dev/sdc1", "/mnt/my data", "xfs", []string{"rw", "relatime", "attr2", "inode64", "prjquota"}},
+		{"/dev/sdd1", `/mnt/back\slash`, "ext4", []string{"rw", "relatime", "data=ordered", "jqfmt=vfsv0", "grpjquota=aquota.group"}},
+		{"overlay", "/var/lib/pouch/rootfs", "overlay", []string{"rw", "relatime", "lowerdir=/l1:/l2", "upperdir=/u", "workdir=/w"}},
+	}
+	if len(mounts) != len(expected) {
+		t.Fatalf("expect %d mounts, got %d", len(expected), len(mounts))
+	}
+	for i := range expected {
+		if !reflect.DeepEqual(*mounts[i], expected[i]) {
+			t.Errorf("expect mount %d to be %+v, got %+v", i, expected[i], *mounts[i])
+		}
+	}
+
+	if !mounts[3].hasOption("prjquota") || mounts[0].hasOption("prjquota") {
+		t.Errorf("expect prjquota to be set only on /home/pouch")
+	}
+	if !mounts[2].hasOption("size") {
+		t.Errorf("expect size to be set on /dev/shm")
+	}
+	if v, ok := mounts[5].option("grpjquota"); !ok || v != "aquota.group" {
+		t.Errorf("expect grpjquota=aquota.group, got (%s, %v)", v, ok)
+	}
+	if v, ok := mounts[6].option("lowerdir"); !ok || v != "/l1:/l2" {
+		t.Errorf("expect lowerdir=/l1:/l2, got (%s, %v)", v, ok)
+	}
+}
+
+func Test_unescapeMountField(t *testing.T) {
+	for in, out := range map[string]string{
+		"/mnt/data":       "/mnt/data",
+		`/mnt/my\040data`: "/mnt/my data",
+		`/mnt/a\011b`:     "/mnt/a\tb",
+		`/mnt/a\012b`:     "/mnt/a\nb",
+		`/mnt/a\134b`:     `/mnt/a\b`,
+		`/mnt/a\9b`:       `/mnt/a\9b`,
+		`/mnt/a\04`:       `/mnt/a\04`,
+	} {
+		if got := unescapeMountField(in); got != out {
+			t.Errorf("expect %q to be unescaped to %q, got %q", in, out, got)
+		}
+	}
+}
+
+func Test_findTopMount(t *testing.T) {
+	mounts := parseMounts(`/dev/sdb1 /home/pouch ext4 rw,relatime,data=ordered 0 0
+/dev/sdb2 /home/pouch ext4 rw,relatime,prjquota 0 0
+`)
+
+	top := findTopMount(mounts, "/home/pouch")
+	if top == nil || top.device != "/dev/sdb2" || !top.hasOption("prjquota") {
+		t.Fatalf("expect the top mount /dev/sdb2, got %+v", top)
+	}
+	if m := findTopMount(mounts, "/mnt"); m != nil {
+		t.Fatalf("expect no mount on /mnt, got %+v", m)
+	}
+}
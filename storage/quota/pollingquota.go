@@ -0,0 +1,320 @@
+// +build linux
+
+package quota
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alibaba/pouch/pkg/bytefmt"
+	"github.com/alibaba/pouch/pkg/log"
+
+	"github.com/pkg/errors"
+)
+
+// defaultPollInterval is the default interval to poll the disk usage of directory.
+const defaultPollInterval = 30 * time.Second
+
+// pollingFallback is used to set quota on the directory which kernel quota can not be
+// enforced on, nil means no fallback.
+var pollingFallback *PollingQuotaDriver
+
+// SetPollingFallback sets the polling quota driver used as fallback when neither project
+// nor group quota can be enforced on the directory, nil disables the fallback.
+func SetPollingFallback(driver *PollingQuotaDriver) {
+	pollingFallback = driver
+}
+
+// StopPolling stops polling the disk usage of the directories by the fallback driver,
+// it should be called when the directories are removed, such as the container or volume
+// is removed.
+func StopPolling(dirs ...string) {
+	if pollingFallback == nil {
+		return
+	}
+	for _, dir := range dirs {
+		if dir != "" {
+			pollingFallback.Remove(dir)
+		}
+	}
+}
+
+// PollingQuotaDriver represents the best-effort quota driver for the host on which
+// kernel quota can not be enabled. The disk usage of directory is polled periodically
+// by `du`, and the ThresholdFunc is called when it exceeds the size, such as to stop
+// the container. Pay attention, it is not enforced by kernel, the directory may grow
+// beyond the size between polls, and quota ID is not used.
+type PollingQuotaDriver struct {
+	interval time.Duration
+	callback ThresholdFunc
+	// tools saves the configured path of du.
+	tools toolPaths
+
+	// lock protects limits.
+	lock sync.Mutex
+	// limits saves the size of the directories which are polled.
+	// key: directory.
+	limits map[string]*pollingLimit
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+	stopCh    chan struct{}
+}
+
+// pollingLimit represents the size set on directory.
+type pollingLimit struct {
+	// limit is the size in bytes.
+	limit uint64
+	// exceeded is whether the usage exceeds limit at the last poll.
+	exceeded bool
+}
+
+// PollingOpt is used to modify the polling quota driver setting.
+type PollingOpt func(*PollingQuotaDriver)
+
+// WithPollInterval sets the interval to poll the disk usage of directory.
+func WithPollInterval(interval time.Duration) PollingOpt {
+	return func(quota *PollingQuotaDriver) {
+		if interval > 0 {
+			quota.interval = interval
+		}
+	}
+}
+
+// WithPollToolPath sets the path of du, which is looked up in PATH if not set.
+func WithPollToolPath(tool, path string) PollingOpt {
+	return func(quota *PollingQuotaDriver) {
+		if quota.tools == nil {
+			quota.tools = make(toolPaths)
+		}
+		quota.tools[tool] = path
+	}
+}
+
+// NewPollingQuotaDriver returns a polling quota driver which calls callback when the disk
+// usage of directory exceeds its size. The callback is fired once when exceeding, and fired
+// again only after the usage falls below the size and exceeds it again. The exceeding is
+// only logged if callback is nil.
+func NewPollingQuotaDriver(callback ThresholdFunc, opts ...PollingOpt) *PollingQuotaDriver {
+	quota := &PollingQuotaDriver{
+		interval: defaultPollInterval,
+		callback: callback,
+		limits:   make(map[string]*pollingLimit),
+		stopCh:   make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(quota)
+	}
+	return quota
+}
+
+// EnforceQuota returns the mountpoint of directory, nothing is enforced by kernel.
+func (quota *PollingQuotaDriver) EnforceQuota(dir string) (*MountInfo, error) {
+	log.WithFields(nil, map[string]interface{}{"dir": dir}).Debugf("start polling quota driver")
+
+	devID, err := getDevID(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get device id for directory: (%s)", dir)
+	}
+
+	mountPoint, _, fsType := quota.CheckMountpoint(devID)
+	if mountPoint == "" {
+		return nil, fmt.Errorf("mountPoint not found for the device on which dir (%s) lies", dir)
+	}
+
+	return &MountInfo{
+		MountPoint: mountPoint,
+		DeviceID:   devID,
+		FsType:     fsType,
+	}, nil
+}
+
+// SetDiskQuota starts to poll the disk usage of directory against the size.
+func (quota *PollingQuotaDriver) SetDiskQuota(dir string, size string, quotaID uint32) error {
+	_, err := quota.SetDiskQuotaWithResult(dir, size, quotaID)
+	return err
+}
+
+// SetDiskQuotaWithResult works as SetDiskQuota, and returns the mountpoint and
+// filesystem type of directory, the quota ID is always 0.
+func (quota *PollingQuotaDriver) SetDiskQuotaWithResult(dir string, size string, quotaID uint32) (*SetQuotaResult, error) {
+	log.WithFields(nil, map[string]interface{}{"dir": dir, "quotaID": quotaID}).Debugf("set disk quota, size: %s", size)
+
+	mountInfo, err := quota.EnforceQuota(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to enforce quota, dir: (%s)", dir)
+	}
+
+	limit, err := bytefmt.ToBytes(size)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to change size: (%s) to bytes", size)
+	}
+
+	quota.lock.Lock()
+	quota.limits[dir] = &pollingLimit{limit: limit}
+	quota.lock.Unlock()
+
+	quota.startOnce.Do(quota.start)
+
+	return &SetQuotaResult{
+		MountPoint: mountInfo.MountPoint,
+		FsType:     mountInfo.FsType,
+	}, nil
+}
+
+// CheckMountpoint is used to check mount point.
+// It returns mointpoint, whether the quota can be set and filesystem type of the device,
+// the quota can always be set since it is polled.
+func (quota *PollingQuotaDriver) CheckMountpoint(devID uint64) (string, bool, string) {
+	log.WithFields(nil, map[string]interface{}{"devID": devID}).Debugf("check mountpoint")
+	mount, err := findDeviceMount(devID)
+	if err != nil {
+		log.WithFields(nil, map[string]interface{}{"devID": devID}).
+			Warnf("failed to read file: (%s), err: (%v)", procMountFile, err)
+		return "", false, ""
+	}
+	if mount == nil {
+		return "", false, ""
+	}
+
+	return mount.mountPoint, true, mount.fsType
+}
+
+// GetQuotaIDInFileAttr always returns 0, since polling quota does not use quota ID.
+func (quota *PollingQuotaDriver) GetQuotaIDInFileAttr(dir string) uint32 {
+	return 0
+}
+
+// SetQuotaIDInFileAttr does nothing, since polling quota does not use quota ID.
+func (quota *PollingQuotaDriver) SetQuotaIDInFileAttr(dir string, quotaID uint32) error {
+	return nil
+}
+
+// GetNextQuotaID returns error, since polling quota does not use quota ID.
+func (quota *PollingQuotaDriver) GetNextQuotaID() (uint32, error) {
+	return 0, errors.Errorf("polling quota driver does not support quota id")
+}
+
+// SetFileAttrRecursive does nothing, since polling quota does not use quota ID.
+func (quota *PollingQuotaDriver) SetFileAttrRecursive(dir string, quotaID uint32) error {
+	return nil
+}
+
+// GetDiskQuota returns the disk usage of directory by `du` and its size,
+// the quota ID is always 0.
+func (quota *PollingQuotaDriver) GetDiskQuota(dir string) (*QuotaUsage, error) {
+	used, err := quota.diskUsage(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &QuotaUsage{Used: used}
+	quota.lock.Lock()
+	if l, ok := quota.limits[dir]; ok {
+		usage.Limit = l.limit
+	}
+	quota.lock.Unlock()
+	return usage, nil
+}
+
+// polled returns whether the disk usage of directory is polled.
+func (quota *PollingQuotaDriver) polled(dir string) bool {
+	quota.lock.Lock()
+	defer quota.lock.Unlock()
+
+	_, ok := quota.limits[dir]
+	return ok
+}
+
+// Remove stops polling the disk usage of directory.
+func (quota *PollingQuotaDriver) Remove(dir string) {
+	quota.lock.Lock()
+	defer quota.lock.Unlock()
+
+	delete(quota.limits, dir)
+}
+
+// Stop stops polling the disk usage.
+func (quota *PollingQuotaDriver) Stop() {
+	quota.stopOnce.Do(func() {
+		close(quota.stopCh)
+	})
+}
+
+// start polls the disk usage periodically in background until Stop is called.
+func (quota *PollingQuotaDriver) start() {
+	go func() {
+		ticker := time.NewTicker(quota.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				quota.poll()
+			case <-quota.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// poll checks the disk usage of the polled directories once.
+func (quota *PollingQuotaDriver) poll() {
+	quota.lock.Lock()
+	dirs := make([]string, 0, len(quota.limits))
+	for dir := range quota.limits {
+		dirs = append(dirs, dir)
+	}
+	quota.lock.Unlock()
+
+	for _, dir := range dirs {
+		used, err := quota.diskUsage(dir)
+		if err != nil {
+			log.WithFields(nil, map[string]interface{}{"dir": dir}).Warnf("failed to get disk usage, err: (%v)", err)
+			continue
+		}
+
+		quota.lock.Lock()
+		l, ok := quota.limits[dir]
+		var limit uint64
+		var was, over bool
+		if ok {
+			limit, was = l.limit, l.exceeded
+			over = used > limit
+			l.exceeded = over
+		}
+		quota.lock.Unlock()
+
+		if !ok || !over || was {
+			continue
+		}
+		log.WithFields(nil, map[string]interface{}{"dir": dir}).
+			Warnf("disk usage exceeds quota, used: (%d bytes), limit: (%d bytes)", used, limit)
+		if quota.callback != nil {
+			quota.callback(dir, &QuotaUsage{Used: used, Limit: limit})
+		}
+	}
+}
+
+// diskUsage returns the disk usage of directory in bytes.
+// du -s -k $dir
+func (quota *PollingQuotaDriver) diskUsage(dir string) (uint64, error) {
+	exit, stdout, stderr, err := execRun(0, quota.tools.path("du"), "-s", "-k", dir)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to get disk usage of dir(%s), stdout: (%s), stderr: (%s), exit: (%d)",
+			dir, stdout, stderr, exit)
+	}
+
+	fields := strings.Fields(stdout)
+	if len(fields) == 0 {
+		return 0, errors.Errorf("failed to parse disk usage of dir(%s), stdout: (%s)", dir, stdout)
+	}
+	kbytes, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to parse disk usage of dir(%s), stdout: (%s)", dir, stdout)
+	}
+	return kbytes * 1024, nil
+}
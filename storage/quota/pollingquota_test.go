@@ -0,0 +1,211 @@
+// +build linux
+
+package quota
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPollingQuotaDriverExceed(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+
+	var fired []uint64
+	driver := NewPollingQuotaDriver(func(d string, usage *QuotaUsage) {
+		if d != dir {
+			t.Fatalf("expect callback of %s, got %s", dir, d)
+		}
+		fired = append(fired, usage.Used)
+	}, WithPollInterval(time.Hour))
+	defer driver.Stop()
+
+	if err := driver.SetDiskQuota(dir, "1m", 0); err != nil {
+		t.Fatalf("failed to set disk quota: %v", err)
+	}
+
+	// du reports the usage in kbytes.
+	for _, kbytes := range []uint64{512, 1024, 2048, 4096, 100, 1025} {
+		runner.results["du"] = []fakeResult{{stdout: fmt.Sprintf("%d\t%s\n", kbytes, dir)}}
+		driver.poll()
+	}
+
+	// fired when exceeding 1m, and again after falling below and exceeding again.
+	if len(fired) != 2 || fired[0] != 2048*1024 || fired[1] != 1025*1024 {
+		t.Fatalf("expect callback fired at usage [%d %d], got %v", 2048*1024, 1025*1024, fired)
+	}
+
+	runner.results["du"] = []fakeResult{{stdout: fmt.Sprintf("300\t%s\n", dir)}}
+	usage, err := driver.GetDiskQuota(dir)
+	if err != nil {
+		t.Fatalf("failed to get disk quota: %v", err)
+	}
+	if usage.Used != 300*1024 || usage.Limit != 1024*1024 {
+		t.Fatalf("expect usage 300k of 1m, got %+v", usage)
+	}
+
+	// the removed dir is no longer polled.
+	SetPollingFallback(driver)
+	defer SetPollingFallback(nil)
+	StopPolling(dir)
+	if driver.polled(dir) {
+		t.Fatalf("expect %s not polled after stopping", dir)
+	}
+	runner.results["du"] = []fakeResult{{stdout: fmt.Sprintf("4096\t%s\n", dir)}}
+	driver.poll()
+	if len(fired) != 2 {
+		t.Fatalf("expect no callback for removed dir, got %v", fired)
+	}
+}
+
+func TestPollingQuotaDriverToolPath(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+
+	driver := NewPollingQuotaDriver(nil, WithPollInterval(time.Hour), WithPollToolPath("du", "/opt/bin/du"))
+	defer driver.Stop()
+
+	runner.results["/opt/bin/du"] = []fakeResult{{stdout: fmt.Sprintf("300\t%s\n", dir)}}
+	usage, err := driver.GetDiskQuota(dir)
+	if err != nil {
+		t.Fatalf("failed to get disk quota: %v", err)
+	}
+	if usage.Used != 300*1024 {
+		t.Fatalf("expect usage 300k, got %+v", usage)
+	}
+	if du := runner.executed("du"); len(du) != 0 {
+		t.Fatalf("expect du looked up by the configured path, got %v", du)
+	}
+}
+
+// noProjectFeature is the output of tune2fs for the ext filesystem without project feature.
+const noProjectFeature = "Filesystem features:      ext_attr resize_inode dir_index filetype sparse_super\n"
+
+func TestPollingQuotaFallback(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+	if getMountpointFstype(dir) == "tmpfs" {
+		t.Skipf("%s lies on tmpfs", dir)
+	}
+
+	origin := GQuotaDriver
+	defer func() {
+		GQuotaDriver = origin
+		SetPollingFallback(nil)
+	}()
+	GQuotaDriver = &PrjQuotaDriver{
+		quotaIDs: make(map[uint32]struct{}),
+		lastID:   QuotaMinID,
+	}
+
+	driver := NewPollingQuotaDriver(nil, WithPollInterval(time.Hour))
+	defer driver.Stop()
+	SetPollingFallback(driver)
+
+	// project quota can not be turned on, it is probed without remount.
+	runner.results["tune2fs"] = []fakeResult{{stdout: noProjectFeature}}
+	if err := SetDiskQuota(dir, "1m", QuotaMinID+1); err != nil {
+		t.Fatalf("failed to set disk quota: %v", err)
+	}
+	for _, bin := range []string{"mount", "quotaon", "setquota"} {
+		if cmds := runner.executed(bin); len(cmds) != 0 {
+			t.Fatalf("expect no %s after falling back, got %v", bin, cmds)
+		}
+	}
+	if !driver.polled(dir) {
+		t.Fatalf("expect %s polled after falling back", dir)
+	}
+
+	runner.results["du"] = []fakeResult{{stdout: fmt.Sprintf("2048\t%s\n", dir)}}
+	usage, err := GetDiskQuota(dir)
+	if err != nil {
+		t.Fatalf("failed to get disk quota: %v", err)
+	}
+	if usage.Used != 2048*1024 || usage.Limit != 1024*1024 {
+		t.Fatalf("expect usage 2m of 1m from polling driver, got %+v", usage)
+	}
+}
+
+func TestPollingQuotaRootfs(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+	devID, err := getDevID(dir)
+	if err != nil {
+		t.Fatalf("failed to get dev id of %s: %v", dir, err)
+	}
+
+	basefs, upper, work := filepath.Join(dir, "rootfs"), filepath.Join(dir, "fs"), filepath.Join(dir, "work")
+	for _, d := range []string{basefs, upper, work} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatalf("failed to create %s: %v", d, err)
+		}
+	}
+
+	f, err := ioutil.TempFile("", "mounts")
+	if err != nil {
+		t.Fatalf("failed to create mounts fixture: %v", err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintf(f, "/dev/sdb1 %s ext4 rw,relatime 0 0\n", dir)
+	fmt.Fprintf(f, "overlay %s overlay rw,relatime,lowerdir=/snapshots/1/fs,upperdir=%s,workdir=%s 0 0\n", basefs, upper, work)
+	f.Close()
+
+	originFile, originDevID := procMountFile, mountDevID
+	defer func() {
+		procMountFile, mountDevID = originFile, originDevID
+	}()
+	procMountFile = f.Name()
+	mountDevID = func(mp string) (uint64, error) {
+		if mp == dir {
+			return devID, nil
+		}
+		return 0, nil
+	}
+
+	origin := GQuotaDriver
+	defer func() {
+		GQuotaDriver = origin
+		SetPollingFallback(nil)
+	}()
+	GQuotaDriver = &PrjQuotaDriver{
+		quotaIDs: make(map[uint32]struct{}),
+		lastID:   QuotaMinID,
+	}
+
+	driver := NewPollingQuotaDriver(nil, WithPollInterval(time.Hour))
+	defer driver.Stop()
+	SetPollingFallback(driver)
+
+	runner.results["tune2fs"] = []fakeResult{{stdout: noProjectFeature}, {stdout: noProjectFeature}}
+	id, err := SetRootfsDiskQuota(basefs, "1m", 0, false)
+	if err != nil {
+		t.Fatalf("failed to set rootfs disk quota: %v", err)
+	}
+	if id != 0 {
+		t.Fatalf("expect no quota id for polled rootfs, got %d", id)
+	}
+	for _, bin := range []string{"mount", "quotaon", "setquota", "chattr", "repquota"} {
+		if cmds := runner.executed(bin); len(cmds) != 0 {
+			t.Fatalf("expect no %s for polled rootfs, got %v", bin, cmds)
+		}
+	}
+	if !driver.polled(upper) || !driver.polled(work) {
+		t.Fatalf("expect %s and %s polled", upper, work)
+	}
+}
@@ -5,21 +5,41 @@ package quota
 import (
 	"fmt"
 	"io/ioutil"
+	"math"
+	"os"
 	"path"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/alibaba/pouch/pkg/bytefmt"
-	"github.com/alibaba/pouch/pkg/exec"
 	"github.com/alibaba/pouch/pkg/log"
-	"github.com/alibaba/pouch/pkg/system"
 
 	"github.com/pkg/errors"
 )
 
+const (
+	// selfTestQuotaSize is the quota size used by self test.
+	selfTestQuotaSize = "1m"
+
+	// selfTestWriteSize is the data size written by self test, it must exceed selfTestQuotaSize.
+	selfTestWriteSize = 2 * 1024 * 1024
+
+	// freeIDBatch is the number of free quota ids scanned at a time.
+	freeIDBatch = 64
+
+	// chattrBatch is the number of directories passed to chattr at a time.
+	chattrBatch = 256
+)
+
 // PrjQuotaDriver represents project quota driver.
 type PrjQuotaDriver struct {
+	// lock protects the global quota id pool: quotaIDs, foreignIDs, lastID, freeIDs and quotaDirs,
+	// and the applied quota records.
 	lock sync.Mutex
 
 	// quotaIDs saves all of quota ids.
@@ -27,15 +47,96 @@ type PrjQuotaDriver struct {
 	// value: stuct{}
 	quotaIDs map[uint32]struct{}
 
-	// lastID is used to mark last used quota ID.
+	// foreignIDs saves the quota ids in use on host which are neither allocated by driver
+	// nor recorded in journal, they are set outside of pouch.
+	foreignIDs map[uint32]struct{}
+
+	// lastID is used to mark last quota ID scanned into freeIDs.
 	// quota ID is allocated increasingly by sequence one by one.
 	lastID uint32
+
+	// journal records the allocated quota ids in state dir.
+	journal *idJournal
+
+	// freeIDs caches the unused quota ids after lastID, they are allocated in order.
+	freeIDs []uint32
+
+	// quotaDirs saves the directory which quota id is allocated for by driver.
+	// key: quota ID, value: directory.
+	quotaDirs map[uint32]string
+
+	// remountRetries is the max retry times of remount when filesystem is busy.
+	remountRetries int
+
+	// rejectConflict makes setting a quota id on the directory which holds
+	// another one fail with ErrQuotaIDConflict, instead of reassigning it.
+	rejectConflict bool
+
+	// denyDirs saves the directories which quota is never applied on, besides the host root.
+	denyDirs []string
+
+	// inheritFiles is the number of files in directory, above which the quota id is only
+	// set on the directories with inherit flag instead of on every file, 0 means no limit.
+	inheritFiles int
+
+	// remountOptions are the options appended to the existing ones on remount,
+	// prjquota is always appended.
+	remountOptions []string
+
+	// applied saves the quota which has been applied on directory by driver,
+	// setting the same quota again is a no-op.
+	// key: directory.
+	applied map[string]appliedQuota
+
+	// devLocks saves the lock of each device, which serializes the quota enforcement
+	// on the same device, while the ones on different devices run in parallel.
+	// key: device ID.
+	devLocks map[uint64]*sync.Mutex
+
+	// devLocksLock protects devLocks.
+	devLocksLock sync.Mutex
+
+	// tools saves the configured paths of quota tools.
+	tools toolPaths
+
+	// audit receives the record of quota change, nil means no audit.
+	audit AuditSink
+
+	// suspended saves the original limits of the directory whose quota is suspended.
+	// key: directory.
+	suspended map[string]*QuotaUsage
+
+	// suspendedLock protects suspended.
+	suspendedLock sync.Mutex
+
+	// idCache caches the quota id read from file attr for a short time.
+	// key: directory.
+	idCache map[string]cachedQuotaID
+
+	// idCacheLock protects idCache.
+	idCacheLock sync.Mutex
+
+	// idStrategy decides the order in which quota ids are allocated, nil means sequential.
+	idStrategy IDStrategy
+
+	// settingIDs saves the quota ids whose limit is being set, they are kept by
+	// GarbageCollectIDs until the quota is recorded as applied.
+	// key: quota ID, value: number of the settings in progress.
+	settingIDs map[uint32]int
+}
+
+// appliedQuota represents the quota applied on a directory.
+type appliedQuota struct {
+	// limit and softLimit are the block hard and soft limits in kbytes.
+	limit     uint64
+	softLimit uint64
+	result    SetQuotaResult
 }
 
 // EnforceQuota is used to enforce disk quota effect on specified directory.
 // it returns the mountpoint and error.
 func (quota *PrjQuotaDriver) EnforceQuota(dir string) (*MountInfo, error) {
-	log.With(nil).Debugf("start project quota driver: (%s)", dir)
+	log.WithFields(nil, map[string]interface{}{"dir": dir}).Debugf("start project quota driver")
 
 	// get device id for set directory.
 	devID, err := getDevID(dir)
@@ -43,29 +144,55 @@ func (quota *PrjQuotaDriver) EnforceQuota(dir string) (*MountInfo, error) {
 		return nil, errors.Wrapf(err, "failed to get device id for directory: (%s)", dir)
 	}
 
+	devLock := quota.deviceLock(devID)
+	devLock.Lock()
+	defer devLock.Unlock()
+
 	mountPoint, hasQuota, fsType := quota.CheckMountpoint(devID)
 	if mountPoint == "" {
 		return nil, fmt.Errorf("mountPoint not found for the device on which dir (%s) lies", dir)
 	}
+	if err := checkOverlayMount(dir, mountPoint, fsType); err != nil {
+		return nil, err
+	}
 	if !hasQuota {
+		if isExtFs(fsType) {
+			// remount with prjquota succeeds on ext family without project feature,
+			// but project quota does not work at all, so check it first.
+			devPath, err := getMountpointDevice(mountPoint)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to get device of mountpoint: (%s)", mountPoint)
+			}
+			enabled, err := isProjectFeatureEnabled(quota.tools.path("tune2fs"), devPath)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to check project feature, device: (%s)", devPath)
+			}
+			if !enabled && fsType != "ext4" {
+				// the project feature needs large inode, which the legacy ext2/ext3
+				// filesystem is often formatted without.
+				return nil, errors.Errorf("project feature is not enabled on %s device (%s), %s may not support project quota, "+
+					"run tune2fs -O project %s or use ext4 instead", fsType, devPath, fsType, devPath)
+			}
+			if !enabled {
+				return nil, errors.Errorf("project feature is not enabled on device (%s), run tune2fs -O project %s",
+					devPath, devPath)
+			}
+		}
+
 		// remount option prjquota for mountpoint
-		exit, stdout, stderr, err := exec.Run(0, "mount", "-o", "remount,prjquota", mountPoint)
-		if err != nil {
-			log.With(nil).Errorf("failed to remount prjquota, mountpoint: (%s), stdout: (%s), stderr: (%s), exit: (%d), err: (%v)",
-				mountPoint, stdout, stderr, exit, err)
-			return nil, errors.Wrapf(err, "failed to remount prjquota, mountpoint: (%s), stdout: (%s), stderr: (%s), exit: (%d)",
-				mountPoint, stdout, stderr, exit)
+		if err := quota.remountPrjquota(mountPoint); err != nil {
+			return nil, err
 		}
 	}
 
 	// use tool quotaon to set disk quota for mountpoint
-	exit, stdout, stderr, err := exec.Run(0, "quotaon", "-P", mountPoint)
+	exit, stdout, stderr, err := execRun(0, quota.tools.path("quotaon"), "-P", mountPoint)
 	if err != nil {
 		if strings.Contains(stderr, " File exists") {
 			err = nil
 		} else {
-			log.With(nil).Errorf("failed to quota on, mountpoint: (%s), stdout: (%s), stderr: (%s), exit: (%d), err: (%v)",
-				mountPoint, stdout, stderr, exit, err)
+			log.WithFields(nil, map[string]interface{}{"dir": dir, "devID": devID, "fstype": fsType, "mountpoint": mountPoint}).
+				Errorf("failed to quota on, stdout: (%s), stderr: (%s), exit: (%d), err: (%v)", stdout, stderr, exit, err)
 			err = errors.Wrapf(err, "failed to quota on, mountpoint: (%s), stdout: (%s), stderr: (%s), exit: (%d)",
 				mountPoint, stdout, stderr, exit)
 			mountPoint = ""
@@ -79,19 +206,175 @@ func (quota *PrjQuotaDriver) EnforceQuota(dir string) (*MountInfo, error) {
 	}, err
 }
 
+// probeQuota checks whether project quota can be enforced on the directory, without the
+// side effect of EnforceQuota, such as remount. It is enforceable if the mount has prjquota
+// option, or it is ext family with project feature, which EnforceQuota remounts with prjquota.
+func (quota *PrjQuotaDriver) probeQuota(dir string) error {
+	devID, err := getDevID(dir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get device id for directory: (%s)", dir)
+	}
+
+	mountPoint, hasQuota, fsType := quota.CheckMountpoint(devID)
+	if mountPoint == "" {
+		return fmt.Errorf("mountPoint not found for the device on which dir (%s) lies", dir)
+	}
+	if err := checkOverlayMount(dir, mountPoint, fsType); err != nil {
+		return err
+	}
+	if hasQuota {
+		return nil
+	}
+	if !isExtFs(fsType) {
+		return errors.Errorf("project quota is not enabled on %s mountpoint (%s)", fsType, mountPoint)
+	}
+
+	devPath, err := getMountpointDevice(mountPoint)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get device of mountpoint: (%s)", mountPoint)
+	}
+	enabled, err := isProjectFeatureEnabled(quota.tools.path("tune2fs"), devPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to check project feature, device: (%s)", devPath)
+	}
+	if !enabled {
+		return errors.Errorf("project feature is not enabled on device (%s)", devPath)
+	}
+	return nil
+}
+
+// EnableOnMounts enables project quota on the mounts up front, such as at daemon startup,
+// so that the first quota setting does not remount the filesystem. EnforceQuota is still
+// done lazily for the other mounts. The failure of a mount is logged, and the error lists
+// the result of every failed mount.
+func (quota *PrjQuotaDriver) EnableOnMounts(mounts []string) error {
+	var failed []string
+	for _, mount := range mounts {
+		mountInfo, err := quota.EnforceQuota(mount)
+		if err != nil {
+			log.WithFields(nil, map[string]interface{}{"mountpoint": mount}).Errorf("failed to enable project quota, err: (%v)", err)
+			failed = append(failed, fmt.Sprintf("%s: %v", mount, err))
+			continue
+		}
+		log.WithFields(nil, map[string]interface{}{"devID": mountInfo.DeviceID, "fstype": mountInfo.FsType, "mountpoint": mountInfo.MountPoint}).
+			Infof("enable project quota")
+	}
+
+	if len(failed) > 0 {
+		return errors.Errorf("failed to enable project quota on mounts: (%s)", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// deviceLock returns the lock of the device.
+func (quota *PrjQuotaDriver) deviceLock(devID uint64) *sync.Mutex {
+	quota.devLocksLock.Lock()
+	defer quota.devLocksLock.Unlock()
+
+	if quota.devLocks == nil {
+		quota.devLocks = make(map[uint64]*sync.Mutex)
+	}
+	l, ok := quota.devLocks[devID]
+	if !ok {
+		l = &sync.Mutex{}
+		quota.devLocks[devID] = l
+	}
+	return l
+}
+
+// remountPrjquota remounts the mountpoint with option prjquota.
+// The options of the existing mount are preserved, since the bare remount may drop
+// the options set at original mount time, and the configured remount options are
+// appended as well.
+// The remount fails with EBUSY when files are being migrated on the filesystem,
+// it is often transient, so remount is retried for remountRetries times.
+func (quota *PrjQuotaDriver) remountPrjquota(mountPoint string) error {
+	option := buildRemountOption(getMountOptions(mountPoint), quota.remountOptions)
+	for i := 0; ; i++ {
+		exit, stdout, stderr, err := execRun(0, quota.tools.path("mount"), "-o", option, mountPoint)
+		if err == nil {
+			return nil
+		}
+
+		if isBusy(stderr) && i < quota.remountRetries {
+			log.WithFields(nil, map[string]interface{}{"mountpoint": mountPoint}).
+				Warnf("mountpoint is busy, retry to remount prjquota (%d/%d)", i+1, quota.remountRetries)
+			time.Sleep(remountRetryInterval)
+			continue
+		}
+
+		log.WithFields(nil, map[string]interface{}{"mountpoint": mountPoint}).
+			Errorf("failed to remount prjquota, stdout: (%s), stderr: (%s), exit: (%d), retries: (%d), err: (%v)",
+				stdout, stderr, exit, i, err)
+		return errors.Wrapf(err, "failed to remount prjquota, mountpoint: (%s), stdout: (%s), stderr: (%s), exit: (%d), retries: (%d)",
+			mountPoint, stdout, stderr, exit, i)
+	}
+}
+
+// getMountOptions returns the options of the top mount on the mountpoint,
+// it returns nil if the mountpoint is not found.
+func getMountOptions(mountPoint string) []string {
+	mounts, err := readMounts()
+	if err != nil {
+		log.WithFields(nil, map[string]interface{}{"mountpoint": mountPoint}).
+			Warnf("failed to read file: (%s), err: (%v)", procMountFile, err)
+		return nil
+	}
+
+	if m := findTopMount(mounts, mountPoint); m != nil {
+		return m.options
+	}
+	return nil
+}
+
+// buildRemountOption returns the option string of remount, which keeps the existing
+// options, and appends the extra options and prjquota if they are not set yet.
+//
+// rw,relatime,data=ordered => remount,rw,relatime,data=ordered,prjquota
+func buildRemountOption(existing, extra []string) string {
+	options := []string{"remount"}
+	set := map[string]struct{}{"remount": {}}
+	all := make([]string, 0, len(existing)+len(extra)+1)
+	all = append(append(append(all, existing...), extra...), "prjquota")
+	for _, opt := range all {
+		if _, ok := set[opt]; ok || opt == "" {
+			continue
+		}
+		set[opt] = struct{}{}
+		options = append(options, opt)
+	}
+	return strings.Join(options, ",")
+}
+
+// isExtFs checks the filesystem type is of ext family, which shares the quota tools
+// setquota, quotaon and chattr, and the project feature in superblock.
+func isExtFs(fsType string) bool {
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		return true
+	}
+	return false
+}
+
+// isBusy checks the stderr of mount means the filesystem is busy (EBUSY).
+func isBusy(stderr string) bool {
+	return strings.Contains(stderr, "busy")
+}
+
 // SetSubtree is used to set quota id for substree dir which is container's root dir.
 // For container, it has its own root dir.
 // And this dir is a subtree of the host dir which is mapped to a device.
 // ext4: chattr -p quotaid +P $DIR
 func (quota *PrjQuotaDriver) setQuotaID(dir string, qid uint32, mountInfo *MountInfo) (uint32, error) {
-	log.With(nil).Debugf("set subtree, dir: %s, quotaID: %d", dir, qid)
+	log.WithFields(nil, map[string]interface{}{"dir": dir, "quotaID": qid}).Debugf("set subtree")
 
 	if isRegular, err := CheckRegularFile(dir); err != nil || !isRegular {
-		log.With(nil).Debugf("set quota id skip not regular file: %s", dir)
+		log.WithFields(nil, map[string]interface{}{"dir": dir}).Debugf("set quota id skip not regular file")
 		return 0, errors.Errorf("file(%s) is not regular file", dir)
 	}
 
 	id := qid
+	allocated, recursive := false, false
 	var err error
 	if id == 0 {
 		id = quota.GetQuotaIDInFileAttr(dir)
@@ -101,48 +384,321 @@ func (quota *PrjQuotaDriver) setQuotaID(dir string, qid uint32, mountInfo *Mount
 		if id, err = quota.GetNextQuotaID(); err != nil {
 			return 0, errors.Wrapf(err, "failed to get file: (%s) quota id", dir)
 		}
+		allocated = true
+	} else {
+		if err := quota.checkQuotaIDInUse(dir, id, mountInfo); err != nil {
+			return 0, err
+		}
+
+		// the directory holds another quota id, the files in it are accounted
+		// to the old one, so they are reassigned as well unless it is rejected.
+		// The quota id inherited from the parent is not a conflict, such as the
+		// volume created in container rootfs.
+		if prev := quota.GetQuotaIDInFileAttr(dir); prev != 0 && prev != id {
+			if quota.rejectConflict && prev != quota.GetQuotaIDInFileAttr(path.Dir(dir)) {
+				return 0, errors.Wrapf(ErrQuotaIDConflict, "dir(%s) holds quota id(%d), failed to set quota id(%d)",
+					dir, prev, id)
+			}
+			log.WithFields(nil, map[string]interface{}{"dir": dir, "quotaID": id}).
+				Infof("reassign quota id from (%d) recursively", prev)
+			recursive = true
+		}
 	}
 
 	strid := strconv.FormatUint(uint64(id), 10)
-	exit, stdout, stderr, err := exec.Run(0, "chattr", "-p", strid, "+P", dir)
-	log.With(nil).Infof("set quota id, dir: (%s), quota id: (%s), stdout: (%s), stderr: (%s), exit: (%d)",
-		dir, strid, stdout, stderr, exit)
+	args := []string{"-p", strid, "+P", dir}
+	if recursive {
+		args = append([]string{"-R"}, args...)
+	}
+	exit, stdout, stderr, err := execRun(0, quota.tools.path("chattr"), args...)
+	quota.invalidateQuotaID(dir, recursive)
+	log.WithFields(nil, map[string]interface{}{"dir": dir, "quotaID": id, "devID": mountInfo.DeviceID, "fstype": mountInfo.FsType}).
+		Infof("set quota id, stdout: (%s), stderr: (%s), exit: (%d)", stdout, stderr, exit)
+	if err == nil && allocated {
+		quota.lock.Lock()
+		if quota.quotaDirs == nil {
+			quota.quotaDirs = make(map[uint32]string)
+		}
+		quota.quotaDirs[id] = dir
+		quota.lock.Unlock()
+	}
+	if err == nil && !allocated {
+		quota.adoptQuotaID(id)
+	}
 	return id, errors.Wrapf(err, "failed to chattr, dir: (%s), quota id: (%s), stdout: (%s), stderr: (%s), exit: (%d)",
 		dir, strid, stdout, stderr, exit)
 }
 
+// checkQuotaIDInUse checks the quota id passed by caller is not bound to another directory.
+// The quota id allocated by driver itself is bound to the directory exclusively,
+// while the quota id allocated by caller could be shared by directories, such as
+// the upper and work dir of container rootfs. The quota id set outside of pouch is
+// in use if it is accounted on the device of directory, unless the directory holds it.
+func (quota *PrjQuotaDriver) checkQuotaIDInUse(dir string, id uint32, mountInfo *MountInfo) error {
+	quota.lock.Lock()
+	if err := quota.loadQuotaIDs(); err != nil {
+		quota.lock.Unlock()
+		return err
+	}
+	bound, ok := quota.quotaDirs[id]
+	_, foreign := quota.foreignIDs[id]
+	quota.lock.Unlock()
+
+	if ok && bound != dir {
+		// the binding is stale if the bound directory does not hold the quota id any more.
+		if quota.GetQuotaIDInFileAttr(bound) == id {
+			return errors.Wrapf(ErrQuotaIDInUse, "quota id(%d) is bound to dir(%s), failed to set it on dir(%s)",
+				id, bound, dir)
+		}
+		quota.lock.Lock()
+		if quota.quotaDirs[id] == bound {
+			delete(quota.quotaDirs, id)
+		}
+		quota.lock.Unlock()
+	}
+
+	if !foreign || quota.GetQuotaIDInFileAttr(dir) == id {
+		return nil
+	}
+
+	exit, stdout, stderr, err := execRun(0, quota.tools.path("repquota"), "-P", "-n", mountInfo.MountPoint)
+	if err != nil {
+		return errors.Wrapf(err, "failed to execute [repquota -P -n %s], stdout: (%s), stderr: (%s), exit: (%d)",
+			mountInfo.MountPoint, stdout, stderr, exit)
+	}
+	if _, err := parseQuotaUsage(stdout, id); err == nil {
+		return errors.Wrapf(ErrQuotaIDInUse, "quota id(%d) is in use on device(%s) outside of pouch, failed to set it on dir(%s)",
+			id, mountInfo.MountPoint, dir)
+	}
+	return nil
+}
+
+// adoptQuotaID records the quota id set by caller in journal, if it is set outside
+// of pouch before, so that it is not treated as a foreign one after restart.
+func (quota *PrjQuotaDriver) adoptQuotaID(id uint32) {
+	quota.lock.Lock()
+	_, foreign := quota.foreignIDs[id]
+	delete(quota.foreignIDs, id)
+	quota.lock.Unlock()
+
+	if !foreign {
+		return
+	}
+	if err := quota.journal.record(id); err != nil {
+		log.WithFields(nil, map[string]interface{}{"quotaID": id}).Warnf("failed to record quota id in journal, err(%v)", err)
+	}
+}
+
 // SetDiskQuota uses the following two parameters to set disk quota for a directory.
 // * quota size: a byte size of requested quota.
 // * quota ID: an ID represent quota attr which is used in the global scope.
 func (quota *PrjQuotaDriver) SetDiskQuota(dir string, size string, quotaID uint32) error {
-	log.With(nil).Debugf("set disk quota, dir: %s, size: %s, quotaID: %d", dir, size, quotaID)
-	mountInfo, err := quota.EnforceQuota(dir)
-	if err != nil {
-		return errors.Wrapf(err, "failed to enforce quota, dir: (%s)", dir)
-	}
-	if mountInfo == nil || mountInfo.MountPoint == "" {
-		return errors.Errorf("failed to find mountpoint, dir: (%s)", dir)
+	_, err := quota.SetDiskQuotaWithResult(dir, size, quotaID)
+	return err
+}
+
+// SetDiskQuotaWithResult works as SetDiskQuota, and returns the quota ID,
+// mountpoint and filesystem type which are actually used.
+// It is a no-op if the same quota has been applied on the directory by driver.
+func (quota *PrjQuotaDriver) SetDiskQuotaWithResult(dir string, size string, quotaID uint32) (*SetQuotaResult, error) {
+	return quota.setDiskQuota(dir, size, quotaID, 0, false)
+}
+
+// SetDiskQuotaWithSoftLimit works as SetDiskQuotaWithResult, and sets the block soft limit
+// to softPercent percent of the hard limit size, softPercent should be in 1-100.
+func (quota *PrjQuotaDriver) SetDiskQuotaWithSoftLimit(dir string, size string, quotaID uint32, softPercent int) (*SetQuotaResult, error) {
+	if softPercent < 1 || softPercent > 100 {
+		return nil, errors.Errorf("invalid soft limit percentage: (%d), it should be in 1-100", softPercent)
 	}
+	return quota.setDiskQuota(dir, size, quotaID, uint64(softPercent), false)
+}
+
+// SetDiskQuotaForce works as SetDiskQuotaWithResult, but always sets the quota
+// even if the same quota has been applied on the directory by driver.
+func (quota *PrjQuotaDriver) SetDiskQuotaForce(dir string, size string, quotaID uint32) (*SetQuotaResult, error) {
+	return quota.setDiskQuota(dir, size, quotaID, 0, true)
+}
+
+// setDiskQuota sets disk quota for directory, softPercent is the percentage of hard limit
+// which block soft limit is set to, 0 means no soft limit.
+func (quota *PrjQuotaDriver) setDiskQuota(dir string, size string, quotaID uint32, softPercent uint64, force bool) (*SetQuotaResult, error) {
+	log.WithFields(nil, map[string]interface{}{"dir": dir, "quotaID": quotaID}).
+		Debugf("set disk quota, size: %s, soft percent: %d, force: %v", size, softPercent, force)
 
 	// transfer limit from kbyte to byte
 	limit, err := bytefmt.ToKilobytes(size)
 	if err != nil {
-		return errors.Wrapf(err, "failed to change size: (%s) to kilobytes", size)
+		return nil, errors.Wrapf(err, "failed to change size: (%s) to kilobytes", size)
 	}
+	softLimit := limit * softPercent / 100
 
-	if err := checkDevLimit(mountInfo, limit*1024); err != nil {
-		return errors.Wrapf(err, "failed to check device limit, dir: (%s), limit: (%d)kb", dir, limit)
+	if err := checkQuotaDir(dir, quota.denyDirs); err != nil {
+		return nil, err
 	}
 
+	if !force {
+		if result := quota.getAppliedQuota(dir, limit, softLimit, quotaID); result != nil {
+			log.WithFields(nil, map[string]interface{}{"dir": dir, "quotaID": result.QuotaID, "fstype": result.FsType}).
+				Debugf("quota has been applied, limit: %d kbytes", limit)
+			return result, nil
+		}
+	}
+
+	mountInfo, err := quota.EnforceQuota(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to enforce quota, dir: (%s)", dir)
+	}
+	if mountInfo == nil || mountInfo.MountPoint == "" {
+		return nil, errors.Errorf("failed to find mountpoint, dir: (%s)", dir)
+	}
+
+	if err := checkDevLimit(mountInfo, limit*1024, 0); err != nil {
+		return nil, errors.Wrapf(err, "failed to check device limit, dir: (%s), limit: (%d)kb", dir, limit)
+	}
+
+	oldLimit := quota.getAppliedLimit(dir) * 1024
+	prevID := quota.GetQuotaIDInFileAttr(dir)
+	if oldLimit == 0 {
+		oldLimit = auditOldLimit(quota.audit, quota.tools.path("repquota"), "-P", prevID, mountInfo.MountPoint)
+	}
 	id, err := quota.setQuotaID(dir, quotaID, mountInfo)
 	if err != nil {
-		return errors.Wrapf(err, "failed to set subtree, dir: (%s), quota id: (%d)", dir, quotaID)
+		return nil, errors.Wrapf(err, "failed to set subtree, dir: (%s), quota id: (%d)", dir, quotaID)
 	}
 	if id == 0 {
-		return errors.Errorf("failed to find quota id to set subtree")
+		return nil, errors.Errorf("failed to find quota id to set subtree")
+	}
+
+	quota.beginSetting(id)
+	defer quota.endSetting(id)
+
+	if err := quota.setQuota(id, softLimit, limit, mountInfo); err != nil {
+		// the directory should not be left with a quota id which has no limit.
+		if id == prevID {
+			return nil, err
+		}
+		if rerr := quota.rollbackQuotaID(dir, id, prevID); rerr != nil {
+			return nil, errors.Wrapf(err, "quota is partially applied, dir: (%s) is left with quota id: (%d) without limit, rollback err: (%v)",
+				dir, id, rerr)
+		}
+		return nil, errors.Wrapf(err, "quota id of dir: (%s) is rolled back to (%d)", dir, prevID)
+	}
+
+	result := &SetQuotaResult{
+		QuotaID:    id,
+		MountPoint: mountInfo.MountPoint,
+		FsType:     mountInfo.FsType,
+	}
+	quota.setAppliedQuota(dir, limit, softLimit, result)
+	audit(quota.audit, AuditRecord{
+		Operation:  AuditSetQuota,
+		Dir:        dir,
+		QuotaID:    id,
+		MountPoint: mountInfo.MountPoint,
+		OldLimit:   oldLimit,
+		NewLimit:   limit * 1024,
+	})
+
+	return result, nil
+}
+
+// rollbackQuotaID restores the quota id of directory from id to prevID, and releases
+// id if it is allocated for the directory by driver.
+// The project inherit flag is cleared as well if prevID is 0. setQuotaID reassigns the
+// files recursively if the directory holds another quota id, so they are restored
+// recursively if prevID is not 0.
+// ext4: chattr [-R] -p $prevID +P $DIR or chattr -p 0 -P $DIR
+func (quota *PrjQuotaDriver) rollbackQuotaID(dir string, id, prevID uint32) error {
+	flag := "+P"
+	if prevID == 0 {
+		flag = "-P"
+	}
+	recursive := prevID != 0
+
+	strid := strconv.FormatUint(uint64(prevID), 10)
+	args := []string{"-p", strid, flag, dir}
+	if recursive {
+		args = append([]string{"-R"}, args...)
+	}
+	exit, stdout, stderr, err := execRun(0, quota.tools.path("chattr"), args...)
+	quota.invalidateQuotaID(dir, recursive)
+	log.WithFields(nil, map[string]interface{}{"dir": dir, "quotaID": id}).
+		Warnf("rollback quota id to (%d), stdout: (%s), stderr: (%s), exit: (%d)", prevID, stdout, stderr, exit)
+	if err != nil {
+		return errors.Wrapf(err, "failed to chattr, dir: (%s), quota id: (%s), stdout: (%s), stderr: (%s), exit: (%d)",
+			dir, strid, stdout, stderr, exit)
+	}
+
+	quota.lock.Lock()
+	allocated := quota.quotaDirs[id] == dir
+	quota.lock.Unlock()
+	if allocated {
+		quota.releaseQuotaID(dir, id)
+	}
+	return nil
+}
+
+// getAppliedQuota returns the result of quota applied on directory,
+// if the limits and quota ID are the same as the requested ones.
+// The quota ID 0 means any quota ID is accepted.
+func (quota *PrjQuotaDriver) getAppliedQuota(dir string, limit, softLimit uint64, quotaID uint32) *SetQuotaResult {
+	quota.lock.Lock()
+	defer quota.lock.Unlock()
+
+	applied, ok := quota.applied[dir]
+	if !ok || applied.limit != limit || applied.softLimit != softLimit ||
+		(quotaID != 0 && quotaID != applied.result.QuotaID) {
+		return nil
+	}
+	result := applied.result
+	return &result
+}
+
+// getAppliedLimit returns the limit in kbytes applied on directory by driver, 0 if unknown.
+func (quota *PrjQuotaDriver) getAppliedLimit(dir string) uint64 {
+	quota.lock.Lock()
+	defer quota.lock.Unlock()
+
+	return quota.applied[dir].limit
+}
+
+// beginSetting marks the limit of quota id is being set, so that it is not collected
+// by GarbageCollectIDs before the quota is recorded as applied.
+func (quota *PrjQuotaDriver) beginSetting(id uint32) {
+	quota.lock.Lock()
+	defer quota.lock.Unlock()
+
+	if quota.settingIDs == nil {
+		quota.settingIDs = make(map[uint32]int)
+	}
+	quota.settingIDs[id]++
+}
+
+// endSetting marks the setting of quota id started by beginSetting is done.
+func (quota *PrjQuotaDriver) endSetting(id uint32) {
+	quota.lock.Lock()
+	defer quota.lock.Unlock()
+
+	if quota.settingIDs[id] <= 1 {
+		delete(quota.settingIDs, id)
+		return
 	}
+	quota.settingIDs[id]--
+}
+
+// setAppliedQuota records the quota applied on directory.
+func (quota *PrjQuotaDriver) setAppliedQuota(dir string, limit, softLimit uint64, result *SetQuotaResult) {
+	quota.lock.Lock()
+	defer quota.lock.Unlock()
 
-	return quota.setQuota(id, limit, mountInfo)
+	if quota.applied == nil {
+		quota.applied = make(map[string]appliedQuota)
+	}
+	quota.applied[dir] = appliedQuota{
+		limit:     limit,
+		softLimit: softLimit,
+		result:    *result,
+	}
 }
 
 // CheckMountpoint is used to check mount point.
@@ -160,70 +716,52 @@ func (quota *PrjQuotaDriver) SetDiskQuota(dir string, size string, quotaID uint3
 // cgroup /sys/fs/cgroup/memory cgroup rw,nosuid,nodev,noexec,relatime,memory 0 0
 // cgroup /sys/fs/cgroup/blkio cgroup rw,nosuid,nodev,noexec,relatime,blkio 0 0
 func (quota *PrjQuotaDriver) CheckMountpoint(devID uint64) (string, bool, string) {
-	log.With(nil).Debugf("check mountpoint, devID: %d", devID)
-	output, err := ioutil.ReadFile(procMountFile)
+	log.WithFields(nil, map[string]interface{}{"devID": devID}).Debugf("check mountpoint")
+	mount, err := findDeviceMount(devID)
 	if err != nil {
-		log.With(nil).Warnf("failed to read file: (%s), err: (%v)", procMountFile, err)
+		log.WithFields(nil, map[string]interface{}{"devID": devID}).
+			Warnf("failed to read file: (%s), err: (%v)", procMountFile, err)
+		return "", false, ""
+	}
+	if mount == nil {
 		return "", false, ""
 	}
 
-	var (
-		enableQuota bool
-		mountPoint  string
-		fsType      string
-	)
-
-	// /dev/sdb1 /home/pouch ext4 rw,relatime,prjquota,data=ordered 0 0
-	for _, line := range strings.Split(string(output), "\n") {
-		parts := strings.Split(line, " ")
-		if len(parts) != 6 {
-			continue
-		}
-
-		devID2, _ := system.GetDevID(parts[1])
-		if devID != devID2 {
-			continue
-		}
-
-		// check the shortest mountpoint.
-		if mountPoint != "" && len(mountPoint) < len(parts[1]) {
-			continue
-		}
-
-		// get device's mountpoint and fs type.
-		mountPoint = parts[1]
-		fsType = parts[2]
+	// get device's mountpoint and fs type.
+	mountPoint, fsType := mount.mountPoint, mount.fsType
 
-		// check the device turn on the prjquota or not.
-		for _, value := range strings.Split(parts[3], ",") {
-			if value == "prjquota" {
-				enableQuota = true
-				break
-			}
-		}
-	}
+	// check the device turn on the prjquota or not.
+	enableQuota := mount.hasOption("prjquota")
 
-	log.With(nil).Debugf("check device: (%d), mountpoint: (%s), enableQuota: (%v), fsType: (%s)",
-		devID, mountPoint, enableQuota, fsType)
+	log.WithFields(nil, map[string]interface{}{"devID": devID, "fstype": fsType, "mountpoint": mountPoint}).
+		Debugf("check device, enableQuota: (%v)", enableQuota)
 
 	return mountPoint, enableQuota, fsType
 }
 
 // setQuota uses system tool "setquota" to set project quota for binding of limit and mountpoint and quotaID.
 // * quotaID: quota ID which means this ID is used in the global scope.
+// * softLimit: block soft limit number for mountpoint, 0 means no soft limit.
 // * blockLimit: block limit number for mountpoint.
 // * mountPoint: the mountpoint of the device in the filesystem
 // ext4: setquota -P qid $softlimit $hardlimit $softinode $hardinode mountpoint
-func (quota *PrjQuotaDriver) setQuota(quotaID uint32, blockLimit uint64, mountInfo *MountInfo) error {
+func (quota *PrjQuotaDriver) setQuota(quotaID uint32, softLimit, blockLimit uint64, mountInfo *MountInfo) error {
 	mountPoint := mountInfo.MountPoint
-	log.With(nil).Debugf("set project quota, quotaID: %d, limit: %d, mountpoint: %s", quotaID, blockLimit, mountPoint)
+	fields := map[string]interface{}{
+		"quotaID":    quotaID,
+		"devID":      mountInfo.DeviceID,
+		"fstype":     mountInfo.FsType,
+		"mountpoint": mountPoint,
+	}
+	log.WithFields(nil, fields).Debugf("set project quota, soft limit: %d, limit: %d", softLimit, blockLimit)
 
 	quotaIDStr := strconv.FormatUint(uint64(quotaID), 10)
+	softLimitStr := strconv.FormatUint(softLimit, 10)
 	blockLimitStr := strconv.FormatUint(blockLimit, 10)
 	// set project quota
-	exit, stdout, stderr, err := exec.Run(0, "setquota", "-P", quotaIDStr, "0", blockLimitStr, "0", "0", mountPoint)
-	log.With(nil).Infof("set quota size, mountpoint: (%s), quota id: (%d), quota: (%d kbytes), stdout: (%s), stderr: (%s), exit: (%d)",
-		mountPoint, quotaID, blockLimit, stdout, stderr, exit)
+	exit, stdout, stderr, err := execRun(0, quota.tools.path("setquota"), "-P", quotaIDStr, softLimitStr, blockLimitStr, "0", "0", mountPoint)
+	log.WithFields(nil, fields).Infof("set quota size, quota: (%d kbytes), stdout: (%s), stderr: (%s), exit: (%d)",
+		blockLimit, stdout, stderr, exit)
 	return errors.Wrapf(err, "failed to set quota, mountpoint: (%s), quota id: (%d), quota: (%d kbytes), stdout: (%s), stderr: (%s), exit: (%d)",
 		mountPoint, quotaID, blockLimit, stdout, stderr, exit)
 }
@@ -231,16 +769,36 @@ func (quota *PrjQuotaDriver) setQuota(quotaID uint32, blockLimit uint64, mountIn
 // GetQuotaIDInFileAttr gets attributes of the file which is in the inode.
 // The returned result is quota ID.
 // return 0 if failure happens, since quota ID must be positive.
-// execution command: `lsattr -p $dir`
+// The quota ID is read by FS_IOC_FSGETXATTR ioctl, and by lsattr if ioctl is not supported.
+// The result is cached for a short time, and the cache is dropped once driver changes it.
 func (quota *PrjQuotaDriver) GetQuotaIDInFileAttr(dir string) uint32 {
+	if qid, ok := quota.getCachedQuotaID(dir); ok {
+		return qid
+	}
+
+	qid, err := getProjectID(dir)
+	if err == nil {
+		log.WithFields(nil, map[string]interface{}{"dir": dir, "quotaID": qid}).Debugf("get file attr by ioctl")
+	} else {
+		log.WithFields(nil, map[string]interface{}{"dir": dir}).Debugf("failed to get file attr by ioctl, err: (%v)", err)
+		qid = quota.getQuotaIDByLsattr(dir)
+	}
+
+	quota.cacheQuotaID(dir, qid)
+	return qid
+}
+
+// getQuotaIDByLsattr gets the quota ID of the file by lsattr.
+// execution command: `lsattr -p $dir`
+func (quota *PrjQuotaDriver) getQuotaIDByLsattr(dir string) uint32 {
 	parent := path.Dir(dir)
 	qid := 0
 
-	exit, stdout, stderr, err := exec.Run(0, "lsattr", "-p", parent)
+	exit, stdout, stderr, err := execRun(0, quota.tools.path("lsattr"), "-p", parent)
 	if err != nil {
 		// failure, then return invalid value 0 for quota ID.
-		log.With(nil).Errorf("failed to lsattr, dir: (%s), stdout: (%s), stderr: (%s), exit: (%d), err: (%v)",
-			dir, stdout, stderr, exit, err)
+		log.WithFields(nil, map[string]interface{}{"dir": dir}).
+			Errorf("failed to lsattr, stdout: (%s), stderr: (%s), exit: (%d), err: (%v)", stdout, stderr, exit, err)
 		return 0
 	}
 
@@ -252,72 +810,832 @@ func (quota *PrjQuotaDriver) GetQuotaIDInFileAttr(dir string) uint32 {
 		if len(parts) > 2 && parts[2] == dir {
 			// find the corresponding quota ID, return directly.
 			qid, _ = strconv.Atoi(parts[0])
-			log.With(nil).Debugf("get file attr: [%s], quota id: [%d]", dir, qid)
+			log.WithFields(nil, map[string]interface{}{"dir": dir, "quotaID": qid}).Debugf("get file attr")
 			return uint32(qid)
 		}
 	}
 
-	log.With(nil).Errorf("failed to get file attr of quota ID for dir %s", dir)
+	log.WithFields(nil, map[string]interface{}{"dir": dir}).Errorf("failed to get file attr of quota ID")
 	return 0
 }
 
 // SetQuotaIDInFileAttr sets file attributes of quota ID for the input directory.
 // The input attributes is quota ID.
 func (quota *PrjQuotaDriver) SetQuotaIDInFileAttr(dir string, quotaID uint32) error {
-	log.With(nil).Debugf("set file attr, dir: %s, quotaID: %d", dir, quotaID)
+	log.WithFields(nil, map[string]interface{}{"dir": dir, "quotaID": quotaID}).Debugf("set file attr")
 
 	if isRegular, err := CheckRegularFile(dir); err != nil || !isRegular {
-		log.With(nil).Debugf("set quota id skip not regular file: %s", dir)
+		log.WithFields(nil, map[string]interface{}{"dir": dir}).Debugf("set quota id skip not regular file")
 		return errors.Errorf("file(%s) is not regular file", dir)
 	}
 
 	strid := strconv.FormatUint(uint64(quotaID), 10)
-	exit, stdout, stderr, err := exec.Run(0, "chattr", "-p", strid, "+P", dir)
+	exit, stdout, stderr, err := execRun(0, quota.tools.path("chattr"), "-p", strid, "+P", dir)
+	quota.invalidateQuotaID(dir, false)
 	return errors.Wrapf(err, "failed to chattr, dir: (%s), quota id: (%d), stdout: (%s), stderr: (%s), exit: (%d)",
 		dir, quotaID, stdout, stderr, exit)
 }
 
 // GetNextQuotaID returns the next available quota id.
+// The ids are taken from the cached free ids, so the lock is only held for a short time,
+// and the journal is written after the lock is released.
 func (quota *PrjQuotaDriver) GetNextQuotaID() (uint32, error) {
+	quota.lock.Lock()
+	if err := quota.loadQuotaIDs(); err != nil {
+		quota.lock.Unlock()
+		return 0, err
+	}
+	if len(quota.freeIDs) == 0 {
+		quota.fillFreeIDs()
+	}
+	if len(quota.freeIDs) == 0 {
+		quota.lock.Unlock()
+		return 0, errors.New("no quota id is available")
+	}
+	id := quota.freeIDs[0]
+	quota.freeIDs = quota.freeIDs[1:]
+	quota.quotaIDs[id] = struct{}{}
+	quota.lock.Unlock()
+
+	if err := quota.journal.record(id); err != nil {
+		log.WithFields(nil, map[string]interface{}{"quotaID": id}).Warnf("failed to record quota id in journal, err(%v)", err)
+	}
+
+	log.WithFields(nil, map[string]interface{}{"quotaID": id}).Debugf("get next project quota id")
+	return id, nil
+}
+
+// loadQuotaIDs loads the quota ids in use on host and in journal once, before the
+// first allocation. It must be called with lock held.
+func (quota *PrjQuotaDriver) loadQuotaIDs() error {
+	if quota.lastID != 0 {
+		return nil
+	}
+
+	var err error
+	quota.quotaIDs, quota.lastID, err = loadQuotaIDs(quota.tools.path("repquota"), "-Pan")
+	if err != nil {
+		return errors.Wrap(err, "failed to load quota list")
+	}
+	quota.foreignIDs = make(map[uint32]struct{}, len(quota.quotaIDs))
+	for id := range quota.quotaIDs {
+		quota.foreignIDs[id] = struct{}{}
+	}
+
+	journaled := make(map[uint32]struct{})
+	quota.lastID = quota.journal.merge(journaled, quota.lastID)
+	for id := range journaled {
+		quota.quotaIDs[id] = struct{}{}
+		delete(quota.foreignIDs, id)
+	}
+	return nil
+}
+
+// FreeIDCount returns the number of quota ids which are still available in the range
+// of allocation, it is the size of range minus the quota ids in use within it. The
+// range is [Min, Max] of RangeStrategy, or the ids after QuotaMinID by default.
+// It returns 0 if the quota ids in use fail to be loaded.
+func (quota *PrjQuotaDriver) FreeIDCount() uint64 {
 	quota.lock.Lock()
 	defer quota.lock.Unlock()
 
-	if quota.lastID == 0 {
-		var err error
-		quota.quotaIDs, quota.lastID, err = loadQuotaIDs("-Pan")
-		if err != nil {
-			return 0, errors.Wrap(err, "failed to load quota list")
+	min, max := uint32(QuotaMinID+1), uint32(math.MaxUint32)
+	switch r := quota.idStrategy.(type) {
+	case RangeStrategy:
+		min, max = r.Min, r.Max
+	case *RangeStrategy:
+		min, max = r.Min, r.Max
+	}
+	if min > max {
+		return 0
+	}
+
+	if err := quota.loadQuotaIDs(); err != nil {
+		log.WithFields(nil, map[string]interface{}{"minID": min, "maxID": max}).
+			Warnf("failed to count free quota ids, err(%v)", err)
+		return 0
+	}
+
+	// the whole range overflows int on 32-bit platform.
+	count := uint64(max-min) + 1
+	for id := range quota.quotaIDs {
+		if id >= min && id <= max {
+			count--
 		}
 	}
+	return count
+}
+
+// fillFreeIDs scans a batch of unused quota ids after lastID into freeIDs,
+// so that the scan is not done on every allocation. It must be called with lock held.
+func (quota *PrjQuotaDriver) fillFreeIDs() {
+	var strategy IDStrategy = sequentialStrategy{}
+	if quota.idStrategy != nil {
+		strategy = quota.idStrategy
+	}
+
 	id := quota.lastID
-	for {
-		if id < QuotaMinID {
-			id = QuotaMinID
+	for len(quota.freeIDs) < freeIDBatch {
+		next, ok := strategy.Next(id)
+		if !ok {
+			break
 		}
-		id++
+		id = next
 		if _, ok := quota.quotaIDs[id]; !ok {
-			break
+			quota.freeIDs = append(quota.freeIDs, id)
 		}
 	}
-	quota.quotaIDs[id] = struct{}{}
 	quota.lastID = id
+}
 
-	log.With(nil).Debugf("get next project quota id: %d", id)
-	return id, nil
+// DebugState returns a snapshot of the internal state of driver, the maps and slices
+// are copied under the lock, so the snapshot never changes with the driver.
+func (quota *PrjQuotaDriver) DebugState() QuotaDriverState {
+	quota.lock.Lock()
+	state := QuotaDriverState{
+		LastID:       quota.lastID,
+		AllocatedIDs: len(quota.quotaIDs),
+		FreeIDs:      append([]uint32(nil), quota.freeIDs...),
+		QuotaDirs:    make(map[uint32]string, len(quota.quotaDirs)),
+	}
+	for id, dir := range quota.quotaDirs {
+		state.QuotaDirs[id] = dir
+	}
+	for dir := range quota.applied {
+		state.AppliedDirs = append(state.AppliedDirs, dir)
+	}
+	quota.lock.Unlock()
+
+	quota.suspendedLock.Lock()
+	for dir := range quota.suspended {
+		state.SuspendedDirs = append(state.SuspendedDirs, dir)
+	}
+	quota.suspendedLock.Unlock()
+
+	quota.devLocksLock.Lock()
+	for devID := range quota.devLocks {
+		state.Devices = append(state.Devices, devID)
+	}
+	quota.devLocksLock.Unlock()
+
+	sort.Strings(state.AppliedDirs)
+	sort.Strings(state.SuspendedDirs)
+	sort.Slice(state.Devices, func(i, j int) bool { return state.Devices[i] < state.Devices[j] })
+	return state
 }
 
 // SetFileAttrRecursive set the file attr by recursively.
 func (quota *PrjQuotaDriver) SetFileAttrRecursive(dir string, quotaID uint32) error {
 	if isRegular, err := CheckRegularFile(dir); err != nil || !isRegular {
-		log.With(nil).Debugf("set quota id skip not regular file: %s", dir)
+		log.WithFields(nil, map[string]interface{}{"dir": dir}).Debugf("set quota id skip not regular file")
 		return errors.Errorf("file(%s) is not regular file", dir)
 	}
 
 	strID := strconv.FormatUint(uint64(quotaID), 10)
 
+	// the files created later inherit the quota id from their directory with +P flag,
+	// so if the tree is too large, the quota id is set on every directory only, and the
+	// pre-existing regular files are left as they are.
+	if quota.inheritFiles > 0 && countFiles(dir, quota.inheritFiles) > quota.inheritFiles {
+		dirs, err := listDirs(dir)
+		if err != nil {
+			return errors.Wrapf(err, "failed to list directories of dir(%s)", dir)
+		}
+		defer quota.invalidateQuotaID(dir, true)
+		for start := 0; start < len(dirs); start += chattrBatch {
+			end := start + chattrBatch
+			if end > len(dirs) {
+				end = len(dirs)
+			}
+			args := append([]string{"-p", strID, "+P"}, dirs[start:end]...)
+			exit, stdout, stderr, err := execRun(0, quota.tools.path("chattr"), args...)
+			if err != nil {
+				return errors.Wrapf(err, "failed to set directories of dir(%s) quota id(%s) with inherit flag, stdout: (%s), stderr: (%s), exit: (%d)",
+					dir, strID, stdout, stderr, exit)
+			}
+		}
+		log.WithFields(nil, map[string]interface{}{"dir": dir, "quotaID": quotaID}).
+			Warnf("set ext4 project quota id on (%d) directories with inherit flag only, the regular files of more than %d files are not re-accounted",
+				len(dirs), quota.inheritFiles)
+		return nil
+	}
+
 	// ext4 use chattr to change project id
-	exit, stdout, stderr, err := exec.Run(0, "chattr", "-R", "-p", strID, "+P", dir)
-	log.With(nil).Infof("set ext4 project quota id recursively, dir: (%s), quota id: (%s), stdout: (%s), stderr: (%s), exit: (%d)",
-		dir, strID, stdout, stderr, exit)
+	exit, stdout, stderr, err := execRun(0, quota.tools.path("chattr"), "-R", "-p", strID, "+P", dir)
+	quota.invalidateQuotaID(dir, true)
+	log.WithFields(nil, map[string]interface{}{"dir": dir, "quotaID": quotaID}).
+		Infof("set ext4 project quota id recursively, stdout: (%s), stderr: (%s), exit: (%d)", stdout, stderr, exit)
 	return errors.Wrapf(err, "failed to set file(%s) quota id(%s) by recursively", dir, strID)
 }
+
+// errStopWalk stops walking the directory tree early.
+var errStopWalk = errors.New("stop walking")
+
+// countFiles returns the number of files under directory, it stops counting
+// once the number exceeds max, so the huge tree is not walked through.
+func countFiles(dir string, max int) int {
+	var count int
+	filepath.Walk(dir, func(path string, fd os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return nil
+		}
+		count++
+		if count > max {
+			return errStopWalk
+		}
+		return nil
+	})
+	return count
+}
+
+// listDirs returns the directory and all the directories under it, the symlinks are
+// not followed.
+func listDirs(dir string) ([]string, error) {
+	var dirs []string
+	err := filepath.Walk(dir, func(path string, fd os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fd.IsDir() {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	return dirs, err
+}
+
+// Reconcile checks the quota id in file attr of directories against the record
+// of daemon which maps directory to quota id, and sets the quota id recursively
+// for the directories which miss it or hold a different one, e.g. after a crash.
+// Failure of a directory is logged and the others are still reconciled.
+func (quota *PrjQuotaDriver) Reconcile(dirs map[string]uint32) error {
+	var failed []string
+	for dir, id := range dirs {
+		if id == 0 {
+			continue
+		}
+
+		fields := map[string]interface{}{"dir": dir, "quotaID": id}
+		got := quota.GetQuotaIDInFileAttr(dir)
+		if got == id {
+			continue
+		}
+
+		log.WithFields(nil, fields).Warnf("quota id in file attr mismatches, got: (%d), reapply it", got)
+		if err := quota.SetFileAttrRecursive(dir, id); err != nil {
+			log.WithFields(nil, fields).Errorf("failed to reconcile quota id, err: (%v)", err)
+			failed = append(failed, dir)
+		}
+	}
+
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return errors.Errorf("failed to reconcile quota id of dirs: (%s)", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// GarbageCollectIDs clears the block limit of the quota ids which have limit in kernel
+// but are referenced by none of liveDirs, and returns the reclaimed ids.
+// liveDirs maps the live directory to its quota id. The ids which quota is applied on or
+// allocated for a directory by the driver are kept too, so it is safe to run while the
+// daemon is setting quota. The reclaimed ids could be allocated again.
+//
+// The live ids are taken under the driver lock, while repquota and setquota run without
+// it. The quota being set is marked by beginSetting, it is checked again before its limit
+// is cleared, and kept in the pool if it becomes live during the collection.
+func (quota *PrjQuotaDriver) GarbageCollectIDs(liveDirs map[string]uint32) ([]uint32, error) {
+	quota.lock.Lock()
+	live := make(map[uint32]struct{})
+	for _, id := range liveDirs {
+		live[id] = struct{}{}
+	}
+	for _, applied := range quota.applied {
+		live[applied.result.QuotaID] = struct{}{}
+	}
+	for id := range quota.quotaDirs {
+		live[id] = struct{}{}
+	}
+	for id := range quota.settingIDs {
+		live[id] = struct{}{}
+	}
+	quota.lock.Unlock()
+
+	cleared, failed, err := quota.collectIDs(live)
+	if err != nil {
+		return nil, err
+	}
+
+	var reclaimed []uint32
+	quota.lock.Lock()
+	for _, id := range cleared {
+		if quota.isLiveID(id) {
+			log.WithFields(nil, map[string]interface{}{"quotaID": id}).Warnf("quota id becomes live while collecting, keep it")
+			continue
+		}
+		delete(quota.foreignIDs, id)
+		if _, ok := quota.quotaIDs[id]; ok {
+			delete(quota.quotaIDs, id)
+			quota.freeIDs = append(quota.freeIDs, id)
+		}
+		reclaimed = append(reclaimed, id)
+	}
+	quota.lock.Unlock()
+
+	// the reclaimed ids are not loaded as allocated from journal after restart.
+	if err := quota.journal.release(reclaimed...); err != nil {
+		log.WithFields(nil, map[string]interface{}{"quotaIDs": reclaimed}).Warnf("failed to release quota ids in journal, err(%v)", err)
+	}
+
+	sort.Slice(reclaimed, func(i, j int) bool { return reclaimed[i] < reclaimed[j] })
+	if len(failed) > 0 {
+		return reclaimed, errors.Errorf("failed to collect quota ids: (%s)", strings.Join(failed, ", "))
+	}
+	return reclaimed, nil
+}
+
+// collectIDs clears the block limit of the quota ids which are not in live for
+// GarbageCollectIDs, and returns the cleared ids and the failed devices and ids.
+// The caller should not hold the lock.
+func (quota *PrjQuotaDriver) collectIDs(live map[uint32]struct{}) ([]uint32, []string, error) {
+	repquota := quota.tools.path("repquota")
+	exit, stdout, stderr, err := execRun(0, repquota, "-Pan")
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to execute [repquota -Pan], stdout: (%s), stderr: (%s), exit: (%d)",
+			stdout, stderr, exit)
+	}
+
+	var (
+		cleared []uint32
+		failed  []string
+	)
+	for device, ids := range parseQuotaLimits(stdout) {
+		mountPoint, err := getDeviceMountpoint(device)
+		if err != nil {
+			log.WithFields(nil, map[string]interface{}{"mountpoint": device}).Warnf("failed to collect quota ids, err: (%v)", err)
+			failed = append(failed, device)
+			continue
+		}
+
+		for _, id := range ids {
+			if _, ok := live[id]; ok {
+				continue
+			}
+			// the quota may start to be set after live ids are taken.
+			quota.lock.Lock()
+			setting := quota.isLiveID(id)
+			quota.lock.Unlock()
+			if setting {
+				continue
+			}
+
+			fields := map[string]interface{}{"quotaID": id, "mountpoint": mountPoint}
+			strID := strconv.FormatUint(uint64(id), 10)
+			exit, stdout, stderr, err := execRun(0, quota.tools.path("setquota"), "-P", strID, "0", "0", "0", "0", mountPoint)
+			if err != nil {
+				log.WithFields(nil, fields).Warnf("failed to clear quota, stdout: (%s), stderr: (%s), exit: (%d), err: (%v)",
+					stdout, stderr, exit, err)
+				failed = append(failed, strID)
+				continue
+			}
+			log.WithFields(nil, fields).Infof("reclaim stale quota id")
+			audit(quota.audit, AuditRecord{Operation: AuditClearQuota, QuotaID: id, MountPoint: mountPoint})
+			cleared = append(cleared, id)
+		}
+	}
+	return cleared, failed, nil
+}
+
+// isLiveID returns whether the quota id is being set, applied on or allocated for a
+// directory by driver. The caller should hold the lock.
+func (quota *PrjQuotaDriver) isLiveID(id uint32) bool {
+	if _, ok := quota.settingIDs[id]; ok {
+		return true
+	}
+	if _, ok := quota.quotaDirs[id]; ok {
+		return true
+	}
+	for _, applied := range quota.applied {
+		if applied.result.QuotaID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// ClearAllQuotas clears the block limit of all project quota ids on the mountpoint,
+// it is used to decommission a disk. The ids without limit are skipped, so it is
+// idempotent. Failure of an id is logged and the others are still cleared.
+// The cleared ids are released, unless they are still applied on other mountpoints.
+func (quota *PrjQuotaDriver) ClearAllQuotas(mountPoint string) error {
+	exit, stdout, stderr, err := execRun(0, quota.tools.path("repquota"), "-P", "-n", mountPoint)
+	if err != nil {
+		return errors.Wrapf(err, "failed to execute [repquota -P -n %s], stdout: (%s), stderr: (%s), exit: (%d)",
+			mountPoint, stdout, stderr, exit)
+	}
+
+	var failed []string
+	cleared := make(map[uint32]struct{})
+	for _, id := range parseLimitedQuotaIDs(stdout) {
+		fields := map[string]interface{}{"quotaID": id, "mountpoint": mountPoint}
+		strID := strconv.FormatUint(uint64(id), 10)
+		exit, stdout, stderr, err := execRun(0, quota.tools.path("setquota"), "-P", strID, "0", "0", "0", "0", mountPoint)
+		if err != nil {
+			log.WithFields(nil, fields).Warnf("failed to clear quota, stdout: (%s), stderr: (%s), exit: (%d), err: (%v)",
+				stdout, stderr, exit, err)
+			failed = append(failed, strID)
+			continue
+		}
+		log.WithFields(nil, fields).Infof("clear quota")
+		audit(quota.audit, AuditRecord{Operation: AuditClearQuota, QuotaID: id, MountPoint: mountPoint})
+		cleared[id] = struct{}{}
+	}
+
+	// the cleared quota should be applied again.
+	var released []uint32
+	quota.lock.Lock()
+	for dir, applied := range quota.applied {
+		if _, ok := cleared[applied.result.QuotaID]; ok && applied.result.MountPoint == mountPoint {
+			delete(quota.applied, dir)
+		}
+	}
+	for id := range cleared {
+		if quota.isLiveID(id) {
+			continue
+		}
+		delete(quota.foreignIDs, id)
+		if _, ok := quota.quotaIDs[id]; ok {
+			delete(quota.quotaIDs, id)
+			quota.freeIDs = append(quota.freeIDs, id)
+		}
+		released = append(released, id)
+	}
+	quota.lock.Unlock()
+
+	// the released ids are not loaded as allocated from journal after restart.
+	if err := quota.journal.release(released...); err != nil {
+		log.WithFields(nil, map[string]interface{}{"mountpoint": mountPoint, "quotaIDs": released}).
+			Warnf("failed to release quota ids in journal, err(%v)", err)
+	}
+
+	if len(failed) > 0 {
+		return errors.Errorf("failed to clear quota ids: (%s) on mountpoint: (%s)", strings.Join(failed, ", "), mountPoint)
+	}
+	return nil
+}
+
+// GetQuotaUsageByID returns the disk usage and limits of all project quota ids on the mountpoint.
+// If some lines of the output are malformed, the usages parsed from the other lines are still
+// returned together with the error.
+// execution command: `repquota -P -n $mountpoint`
+func (quota *PrjQuotaDriver) GetQuotaUsageByID(mountPoint string) (map[uint32]*QuotaUsage, error) {
+	exit, stdout, stderr, err := execRun(0, quota.tools.path("repquota"), "-P", "-n", mountPoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to execute [repquota -P -n %s], stdout: (%s), stderr: (%s), exit: (%d)",
+			mountPoint, stdout, stderr, exit)
+	}
+	return parseQuotaUsages(stdout)
+}
+
+// TotalAllocated returns the sum of block hard limits in bytes of all project quota ids
+// on the mountpoint, which is compared with the device size to know how much the device
+// is oversubscribed.
+// execution command: `repquota -P -n $mountpoint`
+func (quota *PrjQuotaDriver) TotalAllocated(mountPoint string) (uint64, error) {
+	exit, stdout, stderr, err := execRun(0, quota.tools.path("repquota"), "-P", "-n", mountPoint)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to execute [repquota -P -n %s], stdout: (%s), stderr: (%s), exit: (%d)",
+			mountPoint, stdout, stderr, exit)
+	}
+	return parseTotalLimit(stdout)
+}
+
+// QuotaOff turns project quota off on the mountpoint, it is a no-op if quota is already off.
+// execution command: `quotaoff -P $mountpoint`
+func (quota *PrjQuotaDriver) QuotaOff(mountPoint string) error {
+	exit, stdout, stderr, err := execRun(0, quota.tools.path("quotaoff"), "-P", mountPoint)
+	if err != nil {
+		return errors.Wrapf(err, "failed to quota off, mountpoint: (%s), stdout: (%s), stderr: (%s), exit: (%d)",
+			mountPoint, stdout, stderr, exit)
+	}
+	return nil
+}
+
+// Suspend clears the block limit of the quota id of directory temporarily, such as
+// during a bulk import into a volume, and records the original limits, which are
+// restored exactly by Resume. The usage is still accounted while suspended.
+func (quota *PrjQuotaDriver) Suspend(dir string) error {
+	quotaID, mountInfo, err := quota.getDirQuotaMount(dir)
+	if err != nil {
+		return err
+	}
+
+	// the device lock is held until the limit is cleared and recorded, so that the
+	// concurrent Suspend and Resume of directory do not interleave.
+	devLock := quota.deviceLock(mountInfo.DeviceID)
+	devLock.Lock()
+	defer devLock.Unlock()
+
+	if quota.isSuspended(dir) {
+		return errors.Errorf("quota of dir(%s) is already suspended", dir)
+	}
+
+	usage, err := getQuotaUsage(quota.tools.path("repquota"), "-P", quotaID, mountInfo.MountPoint)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get quota limit of dir(%s)", dir)
+	}
+	if usage.Limit == 0 {
+		return errors.Errorf("no block limit is set on quota id(%d) of dir(%s)", quotaID, dir)
+	}
+
+	if err := quota.setQuota(quotaID, 0, 0, mountInfo); err != nil {
+		return errors.Wrapf(err, "failed to suspend quota of dir(%s)", dir)
+	}
+	log.WithFields(nil, map[string]interface{}{"dir": dir, "quotaID": quotaID, "mountpoint": mountInfo.MountPoint}).
+		Infof("suspend quota, limit: (%d bytes), soft limit: (%d bytes)", usage.Limit, usage.SoftLimit)
+	audit(quota.audit, AuditRecord{
+		Operation:  AuditClearQuota,
+		Dir:        dir,
+		QuotaID:    quotaID,
+		MountPoint: mountInfo.MountPoint,
+		OldLimit:   usage.Limit,
+	})
+
+	quota.suspendedLock.Lock()
+	if quota.suspended == nil {
+		quota.suspended = make(map[string]*QuotaUsage)
+	}
+	quota.suspended[dir] = usage
+	quota.suspendedLock.Unlock()
+
+	// the cleared quota should be applied again.
+	quota.lock.Lock()
+	delete(quota.applied, dir)
+	quota.lock.Unlock()
+
+	return nil
+}
+
+// isSuspended returns whether the quota of directory is suspended.
+func (quota *PrjQuotaDriver) isSuspended(dir string) bool {
+	quota.suspendedLock.Lock()
+	defer quota.suspendedLock.Unlock()
+
+	_, ok := quota.suspended[dir]
+	return ok
+}
+
+// Resume restores the block limits of directory recorded by Suspend, and verifies
+// they are applied. It returns error if the quota of directory is not suspended.
+func (quota *PrjQuotaDriver) Resume(dir string) error {
+	quotaID, mountInfo, err := quota.getDirQuotaMount(dir)
+	if err != nil {
+		return err
+	}
+
+	// the device lock is held until the limit is restored and the record is removed.
+	devLock := quota.deviceLock(mountInfo.DeviceID)
+	devLock.Lock()
+	defer devLock.Unlock()
+
+	quota.suspendedLock.Lock()
+	usage, ok := quota.suspended[dir]
+	quota.suspendedLock.Unlock()
+	if !ok {
+		return errors.Errorf("quota of dir(%s) is not suspended", dir)
+	}
+
+	if quotaID != usage.QuotaID {
+		return errors.Errorf("quota id of dir(%s) changes from (%d) to (%d) while suspended", dir, usage.QuotaID, quotaID)
+	}
+
+	if err := quota.setQuota(quotaID, usage.SoftLimit/1024, usage.Limit/1024, mountInfo); err != nil {
+		return errors.Wrapf(err, "failed to resume quota of dir(%s)", dir)
+	}
+
+	current, err := getQuotaUsage(quota.tools.path("repquota"), "-P", quotaID, mountInfo.MountPoint)
+	if err != nil {
+		return errors.Wrapf(err, "failed to verify quota limit of dir(%s)", dir)
+	}
+	if current.Limit != usage.Limit || current.SoftLimit != usage.SoftLimit {
+		return errors.Errorf("failed to verify quota of dir(%s), expect limit (%d) and soft limit (%d), got (%d) and (%d)",
+			dir, usage.Limit, usage.SoftLimit, current.Limit, current.SoftLimit)
+	}
+
+	fields := map[string]interface{}{"dir": dir, "quotaID": quotaID, "mountpoint": mountInfo.MountPoint}
+	if current.Used > current.Limit {
+		log.WithFields(nil, fields).Warnf("quota usage exceeds limit after resume, used: (%d bytes), limit: (%d bytes)",
+			current.Used, current.Limit)
+	}
+	log.WithFields(nil, fields).Infof("resume quota, limit: (%d bytes), soft limit: (%d bytes)", usage.Limit, usage.SoftLimit)
+	audit(quota.audit, AuditRecord{
+		Operation:  AuditSetQuota,
+		Dir:        dir,
+		QuotaID:    quotaID,
+		MountPoint: mountInfo.MountPoint,
+		NewLimit:   usage.Limit,
+	})
+
+	quota.suspendedLock.Lock()
+	delete(quota.suspended, dir)
+	quota.suspendedLock.Unlock()
+
+	return nil
+}
+
+// GetDiskQuota returns the disk usage and limit of the quota id of directory,
+// the usage is read by `repquota -P -n $mountpoint`.
+func (quota *PrjQuotaDriver) GetDiskQuota(dir string) (*QuotaUsage, error) {
+	quotaID, mountInfo, err := quota.getDirQuotaMount(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return getQuotaUsage(quota.tools.path("repquota"), "-P", quotaID, mountInfo.MountPoint)
+}
+
+// getDirQuotaMount returns the quota id of directory and the mount info of the device it lies on.
+func (quota *PrjQuotaDriver) getDirQuotaMount(dir string) (uint32, *MountInfo, error) {
+	quotaID := quota.GetQuotaIDInFileAttr(dir)
+	if quotaID == 0 {
+		return 0, nil, errors.Errorf("no quota id set on dir(%s)", dir)
+	}
+
+	devID, err := getDevID(dir)
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "failed to get device id for directory: (%s)", dir)
+	}
+	mountPoint, _, fsType := quota.CheckMountpoint(devID)
+	if mountPoint == "" {
+		return 0, nil, errors.Errorf("mountPoint not found for the device on which dir (%s) lies", dir)
+	}
+
+	return quotaID, &MountInfo{
+		MountPoint: mountPoint,
+		DeviceID:   devID,
+		FsType:     fsType,
+	}, nil
+}
+
+// isProjectFeatureEnabled checks the ext4 superblock of device has project feature or not.
+// execution command: `tune2fs -l $devPath`
+func isProjectFeatureEnabled(tune2fs, devPath string) (bool, error) {
+	exit, stdout, stderr, err := execRun(0, tune2fs, "-l", devPath)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to tune2fs, device: (%s), stdout: (%s), stderr: (%s), exit: (%d)",
+			devPath, stdout, stderr, exit)
+	}
+
+	return parseProjectFeature(stdout)
+}
+
+// parseProjectFeature parses the output of `tune2fs -l`, example output:
+// Filesystem volume name:   <none>
+// Filesystem features:      has_journal ext_attr resize_inode dir_index filetype extent 64bit flex_bg sparse_super large_file huge_file dir_nlink extra_isize metadata_csum project quota
+// Filesystem flags:         signed_directory_hash
+func parseProjectFeature(output string) (bool, error) {
+	for _, line := range strings.Split(output, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) != "Filesystem features" {
+			continue
+		}
+
+		for _, feature := range strings.Fields(parts[1]) {
+			if feature == "project" {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	return false, errors.Errorf("failed to find filesystem features in tune2fs output")
+}
+
+// SelfTest checks project quota is really enforced on the device which dir lies on.
+// It creates a temporary directory under dir, sets a small quota on it, and then writes
+// data more than the quota, the writing is expected to fail with EDQUOT.
+// The temporary directory and its quota are always cleaned up, and each call uses
+// its own directory and quota id, so it is safe to run concurrently.
+func (quota *PrjQuotaDriver) SelfTest(dir string) error {
+	testDir, err := ioutil.TempDir(dir, "pouch-quota-selftest-")
+	if err != nil {
+		return errors.Wrapf(err, "failed to create self test dir under (%s)", dir)
+	}
+
+	var result *SetQuotaResult
+	defer func() {
+		if result != nil {
+			mountInfo := &MountInfo{MountPoint: result.MountPoint}
+			if err := quota.setQuota(result.QuotaID, 0, 0, mountInfo); err != nil {
+				log.WithFields(nil, map[string]interface{}{"dir": testDir, "quotaID": result.QuotaID}).
+					Warnf("failed to clear self test quota, err: (%v)", err)
+			} else {
+				quota.releaseQuotaID(testDir, result.QuotaID)
+			}
+		}
+		if err := os.RemoveAll(testDir); err != nil {
+			log.WithFields(nil, map[string]interface{}{"dir": testDir}).Warnf("failed to remove self test dir, err: (%v)", err)
+		}
+	}()
+
+	result, err = quota.SetDiskQuotaWithResult(testDir, selfTestQuotaSize, 0)
+	if err != nil {
+		return errors.Wrapf(err, "failed to set self test quota, dir: (%s)", testDir)
+	}
+
+	written, err := writeUntilFail(filepath.Join(testDir, "data"), selfTestWriteSize)
+	if err == nil {
+		return errors.Errorf("quota is not enforced, dir: (%s), mountpoint: (%s), quota id: (%d), quota: (%s), written: (%d bytes)",
+			testDir, result.MountPoint, result.QuotaID, selfTestQuotaSize, written)
+	}
+	if !isQuotaExceeded(err) {
+		return errors.Wrapf(err, "failed to write self test data, dir: (%s), written: (%d bytes)", testDir, written)
+	}
+
+	log.WithFields(nil, map[string]interface{}{"dir": dir, "fstype": result.FsType, "mountpoint": result.MountPoint}).
+		Infof("quota self test passed, written: (%d bytes)", written)
+	return nil
+}
+
+// releaseDirQuota clears the block limit of the quota id of directory, and releases
+// the quota id, it is called before the directory is removed.
+func (quota *PrjQuotaDriver) releaseDirQuota(dir string) error {
+	quotaID, mountInfo, err := quota.getDirQuotaMount(dir)
+	if err != nil {
+		return err
+	}
+
+	oldLimit := auditOldLimit(quota.audit, quota.tools.path("repquota"), "-P", quotaID, mountInfo.MountPoint)
+	if err := quota.setQuota(quotaID, 0, 0, mountInfo); err != nil {
+		return errors.Wrapf(err, "failed to clear quota of dir(%s)", dir)
+	}
+	audit(quota.audit, AuditRecord{
+		Operation:  AuditClearQuota,
+		Dir:        dir,
+		QuotaID:    quotaID,
+		MountPoint: mountInfo.MountPoint,
+		OldLimit:   oldLimit,
+	})
+
+	quota.releaseQuotaID(dir, quotaID)
+	return nil
+}
+
+// releaseQuotaID forgets the quota applied on directory and the quota id allocated for
+// it, and returns the quota id to the free ones, so that it could be allocated again.
+// The caller should have cleared the limit of the quota id.
+func (quota *PrjQuotaDriver) releaseQuotaID(dir string, id uint32) {
+	quota.lock.Lock()
+	delete(quota.applied, dir)
+	if quota.quotaDirs[id] == dir {
+		delete(quota.quotaDirs, id)
+	}
+	delete(quota.foreignIDs, id)
+	if _, ok := quota.quotaIDs[id]; ok {
+		delete(quota.quotaIDs, id)
+		quota.freeIDs = append(quota.freeIDs, id)
+	}
+	quota.lock.Unlock()
+
+	quota.invalidateQuotaID(dir, false)
+	if err := quota.journal.release(id); err != nil {
+		log.WithFields(nil, map[string]interface{}{"dir": dir, "quotaID": id}).Warnf("failed to release quota id in journal, err(%v)", err)
+	}
+}
+
+// writeUntilFail writes size bytes into file and syncs it after each chunk,
+// since the quota may only be checked when the blocks are allocated.
+// It returns the written bytes and the first error.
+func writeUntilFail(file string, size int) (int, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	chunk := make([]byte, 64*1024)
+	written := 0
+	for written < size {
+		n, err := f.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if err := f.Sync(); err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// isQuotaExceeded checks the error is caused by exceeding disk quota.
+func isQuotaExceeded(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	return err == syscall.EDQUOT
+}
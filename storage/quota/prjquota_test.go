@@ -0,0 +1,1307 @@
+// +build linux
+
+package quota
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func Test_parseProjectFeature(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		output  string
+		expect  bool
+		wantErr bool
+	}{
+		{
+			name: "project enabled",
+			output: `tune2fs 1.45.5 (07-Jan-2020)
+Filesystem volume name:   <none>
+Filesystem magic number:  0xEF53
+Filesystem features:      has_journal ext_attr resize_inode dir_index filetype extent 64bit flex_bg sparse_super large_file huge_file dir_nlink extra_isize metadata_csum project quota
+Filesystem flags:         signed_directory_hash
+`,
+			expect: true,
+		},
+		{
+			name: "project disabled",
+			output: `tune2fs 1.45.5 (07-Jan-2020)
+Filesystem volume name:   <none>
+Filesystem features:      has_journal ext_attr resize_inode dir_index filetype extent 64bit flex_bg sparse_super large_file huge_file dir_nlink extra_isize metadata_csum
+Filesystem flags:         signed_directory_hash
+`,
+			expect: false,
+		},
+		{
+			name:    "no features line",
+			output:  "tune2fs 1.45.5 (07-Jan-2020)\n",
+			wantErr: true,
+		},
+	} {
+		got, err := parseProjectFeature(tc.output)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("%s: expect error %v, got %v", tc.name, tc.wantErr, err)
+		}
+		if got != tc.expect {
+			t.Fatalf("%s: expect %v, got %v", tc.name, tc.expect, got)
+		}
+	}
+}
+
+func TestPrjQuotaSelfTestNotEnforced(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+
+	driver := &PrjQuotaDriver{
+		quotaIDs: make(map[uint32]struct{}),
+		lastID:   QuotaMinID,
+	}
+
+	// the fake runner sets no real quota, so the writing never fails.
+	if err := driver.SelfTest(dir); err == nil || !strings.Contains(err.Error(), "quota is not enforced") {
+		t.Fatalf("expect quota not enforced error, got %v", err)
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read dir %s: %v", dir, err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expect self test dir to be cleaned up, got %d entries", len(entries))
+	}
+
+	// the quota is set and then cleared.
+	setquota := runner.executed("setquota")
+	if len(setquota) != 2 || setquota[1][4] != "0" {
+		t.Fatalf("expect quota to be cleared, got %v", setquota)
+	}
+
+	// the quota id is released to the free ones.
+	state := driver.DebugState()
+	if state.AllocatedIDs != 0 || len(state.QuotaDirs) != 0 || len(state.AppliedDirs) != 0 {
+		t.Fatalf("expect self test quota released, got %+v", state)
+	}
+	if state.FreeIDs[len(state.FreeIDs)-1] != QuotaMinID+1 {
+		t.Fatalf("expect quota id %d in free ids, got %v", QuotaMinID+1, state.FreeIDs)
+	}
+}
+
+func Test_isQuotaExceeded(t *testing.T) {
+	if !isQuotaExceeded(&os.PathError{Op: "write", Path: "/data", Err: syscall.EDQUOT}) {
+		t.Fatalf("expect EDQUOT path error to be quota exceeded")
+	}
+	if isQuotaExceeded(&os.PathError{Op: "write", Path: "/data", Err: syscall.ENOSPC}) {
+		t.Fatalf("expect ENOSPC path error not to be quota exceeded")
+	}
+}
+
+func TestPrjQuotaGetNextQuotaIDConcurrently(t *testing.T) {
+	driver := &PrjQuotaDriver{
+		quotaIDs: map[uint32]struct{}{
+			QuotaMinID + 2: {},
+			QuotaMinID + 5: {},
+		},
+		lastID: QuotaMinID,
+	}
+
+	var (
+		wg   sync.WaitGroup
+		lock sync.Mutex
+		ids  = make(map[uint32]struct{})
+	)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				id, err := driver.GetNextQuotaID()
+				if err != nil {
+					t.Errorf("failed to get next quota id: %v", err)
+					return
+				}
+
+				lock.Lock()
+				if _, ok := ids[id]; ok {
+					t.Errorf("quota id %d is allocated twice", id)
+				}
+				if id == QuotaMinID+2 || id == QuotaMinID+5 {
+					t.Errorf("used quota id %d is allocated", id)
+				}
+				ids[id] = struct{}{}
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(ids) != 1600 {
+		t.Fatalf("expect 1600 quota ids, got %d", len(ids))
+	}
+}
+
+func BenchmarkPrjQuotaGetNextQuotaID(b *testing.B) {
+	driver := &PrjQuotaDriver{
+		quotaIDs: make(map[uint32]struct{}),
+		lastID:   QuotaMinID,
+	}
+
+	var ids sync.Map
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			id, err := driver.GetNextQuotaID()
+			if err != nil {
+				b.Fatalf("failed to get next quota id: %v", err)
+			}
+			if _, loaded := ids.LoadOrStore(id, struct{}{}); loaded {
+				b.Fatalf("quota id %d is allocated twice", id)
+			}
+		}
+	})
+}
+
+func TestPrjQuotaSetDiskQuotaIDInUse(t *testing.T) {
+	_, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+
+	dirA, dirB := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	for _, d := range []string{dirA, dirB} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatalf("failed to create dir %s: %v", d, err)
+		}
+	}
+
+	driver := &PrjQuotaDriver{
+		quotaIDs: make(map[uint32]struct{}),
+		lastID:   QuotaMinID,
+	}
+
+	// quota id is allocated by driver for dirA.
+	result, err := driver.SetDiskQuotaWithResult(dirA, "1m", 0)
+	if err != nil {
+		t.Fatalf("failed to set disk quota: %v", err)
+	}
+
+	// set the same quota id again on dirA is idempotent.
+	if err := driver.SetDiskQuota(dirA, "2m", result.QuotaID); err != nil {
+		t.Fatalf("expect setting quota id again on the same dir to succeed, got %v", err)
+	}
+
+	// set the quota id on dirB collides with dirA.
+	err = driver.SetDiskQuota(dirB, "1m", result.QuotaID)
+	if errors.Cause(err) != ErrQuotaIDInUse {
+		t.Fatalf("expect ErrQuotaIDInUse, got %v", err)
+	}
+
+	// the quota id allocated by caller could be shared.
+	id, err := driver.GetNextQuotaID()
+	if err != nil {
+		t.Fatalf("failed to get next quota id: %v", err)
+	}
+	for _, d := range []string{dirA, dirB} {
+		if err := driver.SetDiskQuota(d, "1m", id); err != nil {
+			t.Fatalf("expect shared quota id to be set on %s, got %v", d, err)
+		}
+	}
+}
+
+func TestPrjQuotaSetDiskQuotaForeignID(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+
+	dirA, dirB := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	for _, d := range []string{dirA, dirB} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatalf("failed to create dir %s: %v", d, err)
+		}
+	}
+
+	// the quota id is set on dirA outside of pouch, and loaded from repquota.
+	id := QuotaMinID + 100
+	runner.attrs[dirA] = fmt.Sprint(id)
+	driver := &PrjQuotaDriver{
+		quotaIDs:   map[uint32]struct{}{id: {}},
+		foreignIDs: map[uint32]struct{}{id: {}},
+		lastID:     id,
+	}
+
+	runner.results["repquota"] = []fakeResult{{stdout: fmt.Sprintf("#%d -- 1024 0 0 3 0 0\n", id)}}
+	err := driver.SetDiskQuota(dirB, "1m", id)
+	if errors.Cause(err) != ErrQuotaIDInUse {
+		t.Fatalf("expect ErrQuotaIDInUse, got %v", err)
+	}
+
+	// the directory which holds the quota id adopts it.
+	if err := driver.SetDiskQuota(dirA, "1m", id); err != nil {
+		t.Fatalf("expect setting quota id on the dir holding it to succeed, got %v", err)
+	}
+	if len(driver.foreignIDs) != 0 {
+		t.Fatalf("expect quota id to be adopted, got foreign ids %v", driver.foreignIDs)
+	}
+}
+
+func TestPrjQuotaRemountRetryWhenBusy(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	origin := remountRetryInterval
+	remountRetryInterval = time.Millisecond
+	defer func() {
+		remountRetryInterval = origin
+	}()
+
+	busy := fakeResult{
+		exit:   32,
+		stderr: "mount: /home/pouch: mount point is busy.",
+		err:    fmt.Errorf("exit status 32"),
+	}
+	driver := &PrjQuotaDriver{remountRetries: 3}
+
+	// busy twice, and then succeed.
+	runner.results["mount"] = []fakeResult{busy, busy}
+	if err := driver.remountPrjquota("/home/pouch"); err != nil {
+		t.Fatalf("expect remount to succeed after retries, got %v", err)
+	}
+	if got := len(runner.executed("mount")); got != 3 {
+		t.Fatalf("expect mount to be executed 3 times, got %d", got)
+	}
+
+	// always busy, fail after retries.
+	runner.commands = nil
+	runner.results["mount"] = []fakeResult{busy, busy, busy, busy, busy}
+	if err := driver.remountPrjquota("/home/pouch"); err == nil || !strings.Contains(err.Error(), "retries: (3)") {
+		t.Fatalf("expect remount to fail after 3 retries, got %v", err)
+	}
+	if got := len(runner.executed("mount")); got != 4 {
+		t.Fatalf("expect mount to be executed 4 times, got %d", got)
+	}
+
+	// not busy, fail without retry.
+	runner.commands = nil
+	runner.results["mount"] = []fakeResult{{exit: 32, stderr: "mount: bad option", err: fmt.Errorf("exit status 32")}}
+	if err := driver.remountPrjquota("/home/pouch"); err == nil {
+		t.Fatalf("expect remount to fail")
+	}
+	if got := len(runner.executed("mount")); got != 1 {
+		t.Fatalf("expect mount to be executed once, got %d", got)
+	}
+}
+
+func TestPrjQuotaRemountPreservesOptions(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	f, err := ioutil.TempFile("", "quota-mounts")
+	if err != nil {
+		t.Fatalf("failed to create mounts fixture: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("/dev/sda1 / ext4 rw,relatime 0 0\n" +
+		"/dev/sdb1 /home/pouch ext4 rw,noatime,errors=remount-ro,data=ordered 0 0\n"); err != nil {
+		t.Fatalf("failed to write mounts fixture: %v", err)
+	}
+	f.Close()
+
+	origin := procMountFile
+	defer func() { procMountFile = origin }()
+	procMountFile = f.Name()
+
+	driver := NewQuotaDriver("prjquota", WithRemountOptions("usrquota, prjquota")).(*PrjQuotaDriver)
+	if err := driver.remountPrjquota("/home/pouch"); err != nil {
+		t.Fatalf("failed to remount: %v", err)
+	}
+
+	mount := runner.executed("mount")
+	expect := []string{"mount", "-o", "remount,rw,noatime,errors=remount-ro,data=ordered,usrquota,prjquota", "/home/pouch"}
+	if len(mount) != 1 || strings.Join(mount[0], " ") != strings.Join(expect, " ") {
+		t.Fatalf("expect mount command %v, got %v", expect, mount)
+	}
+}
+
+func Test_buildRemountOption(t *testing.T) {
+	for _, tc := range []struct {
+		existing []string
+		extra    []string
+		expect   string
+	}{
+		{expect: "remount,prjquota"},
+		{existing: []string{"rw", "relatime"}, expect: "remount,rw,relatime,prjquota"},
+		{existing: []string{"rw", "prjquota"}, extra: []string{"usrquota"}, expect: "remount,rw,prjquota,usrquota"},
+		{existing: []string{"rw", "usrquota"}, extra: []string{"usrquota"}, expect: "remount,rw,usrquota,prjquota"},
+	} {
+		if got := buildRemountOption(tc.existing, tc.extra); got != tc.expect {
+			t.Fatalf("expect remount option %s for (%v, %v), got %s", tc.expect, tc.existing, tc.extra, got)
+		}
+	}
+}
+
+func TestPrjQuotaDeviceLock(t *testing.T) {
+	driver := &PrjQuotaDriver{}
+
+	if driver.deviceLock(1) != driver.deviceLock(1) {
+		t.Fatalf("expect the same lock for the same device")
+	}
+	if driver.deviceLock(1) == driver.deviceLock(2) {
+		t.Fatalf("expect different locks for different devices")
+	}
+}
+
+// BenchmarkPrjQuotaDeviceLock runs EnforceQuota in parallel on the directories of one
+// device and of two devices, the quota tools take a while as remount and quotaon do.
+// The enforcement on different devices is not serialized by the device lock.
+func BenchmarkPrjQuotaDeviceLock(b *testing.B) {
+	runner, restore := newFakeRunner()
+	defer restore()
+	execRun = func(timeout time.Duration, bin string, args ...string) (int, string, string, error) {
+		time.Sleep(5 * time.Millisecond)
+		return runner.run(timeout, bin, args...)
+	}
+
+	disk, err := ioutil.TempDir("", "quota-bench")
+	if err != nil {
+		b.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(disk)
+	shm, err := ioutil.TempDir("/dev/shm", "quota-bench")
+	if err != nil {
+		b.Skipf("failed to create dir on /dev/shm: %v", err)
+	}
+	defer os.RemoveAll(shm)
+
+	diskID, _ := getDevID(disk)
+	shmID, _ := getDevID(shm)
+	if diskID == shmID {
+		b.Skipf("%s and %s lie on the same device", disk, shm)
+	}
+
+	for _, bc := range []struct {
+		name string
+		dirs []string
+	}{
+		{name: "one-device", dirs: []string{disk, disk}},
+		{name: "two-devices", dirs: []string{disk, shm}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			driver := &PrjQuotaDriver{
+				quotaIDs: make(map[uint32]struct{}),
+				lastID:   QuotaMinID,
+			}
+			var (
+				next   int
+				nextMu sync.Mutex
+			)
+			b.SetParallelism(len(bc.dirs))
+			b.RunParallel(func(pb *testing.PB) {
+				nextMu.Lock()
+				dir := bc.dirs[next%len(bc.dirs)]
+				next++
+				nextMu.Unlock()
+
+				for pb.Next() {
+					if _, err := driver.EnforceQuota(dir); err != nil {
+						b.Fatalf("failed to enforce quota on %s: %v", dir, err)
+					}
+				}
+			})
+			// drop the recorded commands, they grow with b.N.
+			runner.lock.Lock()
+			runner.commands = nil
+			runner.lock.Unlock()
+		})
+	}
+}
+
+func TestPrjQuotaSetDiskQuotaIdempotent(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+
+	driver := &PrjQuotaDriver{
+		quotaIDs: make(map[uint32]struct{}),
+		lastID:   QuotaMinID,
+	}
+
+	first, err := driver.SetDiskQuotaWithResult(dir, "1m", 0)
+	if err != nil {
+		t.Fatalf("failed to set disk quota: %v", err)
+	}
+	executed := len(runner.commands)
+
+	// the same quota is a no-op.
+	second, err := driver.SetDiskQuotaWithResult(dir, "1m", first.QuotaID)
+	if err != nil {
+		t.Fatalf("failed to set disk quota again: %v", err)
+	}
+	if *second != *first {
+		t.Fatalf("expect result %v, got %v", first, second)
+	}
+	if len(runner.commands) != executed {
+		t.Fatalf("expect no command executed, got %v", runner.commands[executed:])
+	}
+
+	// force or a different size sets the quota again.
+	if _, err := driver.SetDiskQuotaForce(dir, "1m", 0); err != nil {
+		t.Fatalf("failed to force to set disk quota: %v", err)
+	}
+	if _, err := driver.SetDiskQuotaWithResult(dir, "2m", 0); err != nil {
+		t.Fatalf("failed to set disk quota with new size: %v", err)
+	}
+	if got := len(runner.executed("setquota")); got != 3 {
+		t.Fatalf("expect setquota executed 3 times, got %d", got)
+	}
+}
+
+func TestPrjQuotaReconcile(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+
+	matched := filepath.Join(dir, "matched")
+	missing := filepath.Join(dir, "missing")
+	notExist := filepath.Join(dir, "not-exist")
+	for _, d := range []string{matched, missing} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatalf("failed to create dir %s: %v", d, err)
+		}
+	}
+	runner.attrs[matched] = "16777217"
+
+	driver := &PrjQuotaDriver{}
+	err := driver.Reconcile(map[string]uint32{
+		matched:  16777217,
+		missing:  16777218,
+		notExist: 16777219,
+	})
+	if err == nil || !strings.Contains(err.Error(), notExist) {
+		t.Fatalf("expect error of dir %s, got %v", notExist, err)
+	}
+
+	if got := driver.GetQuotaIDInFileAttr(missing); got != 16777218 {
+		t.Fatalf("expect quota id 16777218 reapplied on %s, got %d", missing, got)
+	}
+
+	chattr := runner.executed("chattr")
+	if len(chattr) != 1 || chattr[0][len(chattr[0])-1] != missing {
+		t.Fatalf("expect chattr only on %s, got %v", missing, chattr)
+	}
+}
+
+func TestPrjQuotaToolPath(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+
+	driver := NewQuotaDriver("prjquota", WithToolPath("chattr", "/opt/quota/bin/chattr")).(*PrjQuotaDriver)
+	if err := driver.SetQuotaIDInFileAttr(dir, 16777217); err != nil {
+		t.Fatalf("failed to set quota id: %v", err)
+	}
+	driver.GetQuotaIDInFileAttr(dir)
+
+	if len(runner.commands) != 2 {
+		t.Fatalf("expect 2 commands executed, got %v", runner.commands)
+	}
+	// the configured path is used, others are looked up in PATH.
+	if got := runner.commands[0][0]; got != "/opt/quota/bin/chattr" {
+		t.Fatalf("expect chattr executed by /opt/quota/bin/chattr, got %s", got)
+	}
+	if got := runner.commands[1][0]; got != "lsattr" {
+		t.Fatalf("expect lsattr looked up in PATH, got %s", got)
+	}
+}
+
+func TestPrjQuotaGarbageCollectIDs(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+
+	devID, err := getDevID(dir)
+	if err != nil {
+		t.Fatalf("failed to get dev id of %s: %v", dir, err)
+	}
+	mountPoint, _, _ := (&PrjQuotaDriver{}).CheckMountpoint(devID)
+	device, err := getMountpointDevice(mountPoint)
+	if err != nil {
+		t.Skipf("no device found for %s: %v", mountPoint, err)
+	}
+	if mp, err := getDeviceMountpoint(device); err != nil || mp != mountPoint {
+		t.Skipf("device %s is mounted on %s too", device, mp)
+	}
+
+	report := fmt.Sprintf(`*** Report for project quotas on device %s
+Block grace time: 7days; Inode grace time: 7days
+Project         used    soft    hard  grace    used  soft  hard  grace
+----------------------------------------------------------------------
+#0        --     220       0       0             25     0     0
+#16777217 --       4       0    1024              1     0     0
+#16777218 --       8       0    2048              2     0     0
+#16777219 --       8       0       0              2     0     0
+`, device)
+	runner.results["repquota"] = []fakeResult{{stdout: report}}
+
+	driver := &PrjQuotaDriver{
+		quotaIDs: map[uint32]struct{}{16777217: {}, 16777218: {}, 16777219: {}},
+		lastID:   16777219,
+	}
+	reclaimed, err := driver.GarbageCollectIDs(map[string]uint32{dir: 16777217})
+	if err != nil {
+		t.Fatalf("failed to collect quota ids: %v", err)
+	}
+	if len(reclaimed) != 1 || reclaimed[0] != 16777218 {
+		t.Fatalf("expect quota id 16777218 reclaimed, got %v", reclaimed)
+	}
+
+	expect := []string{"setquota", "-P", "16777218", "0", "0", "0", "0", mountPoint}
+	setquota := runner.executed("setquota")
+	if len(setquota) != 1 || strings.Join(setquota[0], " ") != strings.Join(expect, " ") {
+		t.Fatalf("expect %v executed, got %v", expect, setquota)
+	}
+
+	// the reclaimed id is allocated again.
+	if id, err := driver.GetNextQuotaID(); err != nil || id != 16777218 {
+		t.Fatalf("expect quota id 16777218 allocated again, got %d, err: %v", id, err)
+	}
+
+	// the quota id whose limit is being set is kept, though it is not applied yet.
+	driver.beginSetting(16777218)
+	runner.results["repquota"] = []fakeResult{{stdout: report}}
+	if reclaimed, err := driver.GarbageCollectIDs(map[string]uint32{dir: 16777217}); err != nil || len(reclaimed) != 0 {
+		t.Fatalf("expect no quota id reclaimed while setting, got %v, err: %v", reclaimed, err)
+	}
+	driver.endSetting(16777218)
+	if len(driver.settingIDs) != 0 {
+		t.Fatalf("expect no quota id being set, got %v", driver.settingIDs)
+	}
+
+	// the lock is not held across repquota, and the quota id which starts to be set
+	// during the collection is kept.
+	runner.results["repquota"] = []fakeResult{{stdout: report}}
+	execRun = func(timeout time.Duration, bin string, args ...string) (int, string, string, error) {
+		if bin == "repquota" {
+			driver.beginSetting(16777218)
+		}
+		return runner.run(timeout, bin, args...)
+	}
+	if reclaimed, err := driver.GarbageCollectIDs(map[string]uint32{dir: 16777217}); err != nil || len(reclaimed) != 0 {
+		t.Fatalf("expect no quota id reclaimed which starts to be set, got %v, err: %v", reclaimed, err)
+	}
+	if setquota := runner.executed("setquota"); len(setquota) != 1 {
+		t.Fatalf("expect no more setquota executed, got %v", setquota)
+	}
+	driver.endSetting(16777218)
+}
+
+func TestPrjQuotaSetDiskQuotaRollback(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+
+	driver := &PrjQuotaDriver{
+		quotaIDs: make(map[uint32]struct{}),
+		lastID:   QuotaMinID,
+	}
+
+	runner.results["setquota"] = []fakeResult{{exit: 1, stderr: "setquota: Cannot set quota", err: errors.New("exit status 1")}}
+	if _, err := driver.SetDiskQuotaWithResult(dir, "1m", 0); err == nil || !strings.Contains(err.Error(), "rolled back") {
+		t.Fatalf("expect error of rolled back quota, got %v", err)
+	}
+
+	// the quota id is cleared from file attr and released.
+	chattr := runner.executed("chattr")
+	if len(chattr) != 2 || strings.Join(chattr[1][1:], " ") != "-p 0 -P "+dir {
+		t.Fatalf("expect quota id to be cleared on %s, got %v", dir, chattr)
+	}
+	if got := driver.GetQuotaIDInFileAttr(dir); got != 0 {
+		t.Fatalf("expect no quota id on %s, got %d", dir, got)
+	}
+	if len(driver.quotaDirs) != 0 || len(driver.quotaIDs) != 0 {
+		t.Fatalf("expect quota id to be released, got dirs %v, ids %v", driver.quotaDirs, driver.quotaIDs)
+	}
+
+	// the quota id set before is restored recursively, since the files are reassigned.
+	runner.attrs[dir] = "16777300"
+	runner.results["setquota"] = []fakeResult{{exit: 1, err: errors.New("exit status 1")}}
+	if _, err := driver.SetDiskQuotaWithResult(dir, "1m", 16777301); err == nil {
+		t.Fatalf("expect error of failed setquota")
+	}
+	if got := driver.GetQuotaIDInFileAttr(dir); got != 16777300 {
+		t.Fatalf("expect quota id 16777300 restored on %s, got %d", dir, got)
+	}
+	chattr = runner.executed("chattr")
+	expect := "chattr -R -p 16777300 +P " + dir
+	if len(chattr) != 4 || strings.Join(chattr[3], " ") != expect {
+		t.Fatalf("expect %s, got %v", expect, chattr)
+	}
+}
+
+func TestPrjQuotaClearAllQuotas(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	report := `*** Report for project quotas on device /dev/sdb1
+Block grace time: 7days; Inode grace time: 7days
+Project         used    soft    hard  grace    used  soft  hard  grace
+----------------------------------------------------------------------
+#0        --     220       0       0             25     0     0
+#16777217 --       4       0    1024              1     0     0
+#16777218 +-    2048    1024    4096  6days       2     0     0
+#16777219 --       8       0       0              2     0     0
+`
+	runner.results["repquota"] = []fakeResult{{stdout: report}}
+
+	driver := &PrjQuotaDriver{
+		quotaIDs: map[uint32]struct{}{16777217: {}, 16777218: {}, 16777219: {}},
+		lastID:   16777219,
+		applied: map[string]appliedQuota{
+			"/data/foo": {limit: 1, result: SetQuotaResult{QuotaID: 16777217, MountPoint: "/data"}},
+			"/home/bar": {limit: 1, result: SetQuotaResult{QuotaID: 16777217, MountPoint: "/home"}},
+		},
+	}
+	if err := driver.ClearAllQuotas("/data"); err != nil {
+		t.Fatalf("failed to clear all quotas: %v", err)
+	}
+
+	expect := [][]string{
+		{"setquota", "-P", "16777217", "0", "0", "0", "0", "/data"},
+		{"setquota", "-P", "16777218", "0", "0", "0", "0", "/data"},
+	}
+	if got := runner.executed("setquota"); fmt.Sprint(got) != fmt.Sprint(expect) {
+		t.Fatalf("expect %v executed, got %v", expect, got)
+	}
+	if _, ok := driver.applied["/data/foo"]; ok {
+		t.Fatalf("expect applied quota on /data to be forgotten")
+	}
+	if _, ok := driver.applied["/home/bar"]; !ok {
+		t.Fatalf("expect applied quota on /home to be kept")
+	}
+	// the quota id still applied on /home is not released.
+	if _, ok := driver.quotaIDs[16777217]; !ok {
+		t.Fatalf("expect quota id 16777217 applied on /home to be kept")
+	}
+	if _, ok := driver.quotaIDs[16777218]; ok {
+		t.Fatalf("expect quota id 16777218 to be released")
+	}
+
+	// all limits have been cleared, nothing to do.
+	runner.results["repquota"] = []fakeResult{{stdout: strings.Replace(strings.Replace(report,
+		"0    1024", "0       0", 1), "1024    4096", "0       0", 1)}}
+	if err := driver.ClearAllQuotas("/data"); err != nil {
+		t.Fatalf("failed to clear all quotas again: %v", err)
+	}
+	if got := len(runner.executed("setquota")); got != 2 {
+		t.Fatalf("expect no more setquota executed, got %d", got)
+	}
+}
+
+func TestPrjQuotaSetDiskQuotaWithSoftLimit(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+
+	driver := &PrjQuotaDriver{
+		quotaIDs: make(map[uint32]struct{}),
+		lastID:   QuotaMinID,
+	}
+
+	for _, percent := range []int{0, 101} {
+		if _, err := driver.SetDiskQuotaWithSoftLimit(dir, "10g", 0, percent); err == nil {
+			t.Fatalf("expect error of soft limit percentage %d", percent)
+		}
+	}
+
+	result, err := driver.SetDiskQuotaWithSoftLimit(dir, "10g", 0, 90)
+	if err != nil {
+		if strings.Contains(err.Error(), "device limit") {
+			t.Skipf("device of %s is smaller than 10g: %v", dir, err)
+		}
+		t.Fatalf("failed to set disk quota with soft limit: %v", err)
+	}
+
+	// 90% of 10g (10485760 kbytes) is 9437184 kbytes.
+	expect := []string{"setquota", "-P", fmt.Sprint(result.QuotaID), "9437184", "10485760", "0", "0", result.MountPoint}
+	setquota := runner.executed("setquota")
+	if len(setquota) != 1 || strings.Join(setquota[0], " ") != strings.Join(expect, " ") {
+		t.Fatalf("expect %v executed, got %v", expect, setquota)
+	}
+
+	// the hard limit only is a different quota.
+	if _, err := driver.SetDiskQuotaWithResult(dir, "10g", result.QuotaID); err != nil {
+		t.Fatalf("failed to set disk quota: %v", err)
+	}
+	if got := len(runner.executed("setquota")); got != 2 {
+		t.Fatalf("expect setquota executed 2 times, got %d", got)
+	}
+}
+
+func TestPrjQuotaEnableOnMounts(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+	other, cleanOther := newTestDir(t)
+	defer cleanOther()
+
+	driver := &PrjQuotaDriver{}
+	if err := driver.EnableOnMounts([]string{dir, other}); err != nil {
+		t.Fatalf("failed to enable project quota on mounts: %v", err)
+	}
+	if got := len(runner.executed("quotaon")); got != 2 {
+		t.Fatalf("expect quotaon executed on 2 mounts, got %d", got)
+	}
+
+	// the failed mount is reported, and the others are still enabled.
+	notExist := filepath.Join(dir, "not-exist")
+	err := driver.EnableOnMounts([]string{notExist, other})
+	if err == nil || !strings.Contains(err.Error(), notExist) {
+		t.Fatalf("expect error of mount %s, got %v", notExist, err)
+	}
+	if got := len(runner.executed("quotaon")); got != 3 {
+		t.Fatalf("expect quotaon executed on the other mount, got %d", got)
+	}
+}
+
+func TestPrjQuotaRangeStrategy(t *testing.T) {
+	driver := &PrjQuotaDriver{
+		// 16777300 is in use of another range.
+		quotaIDs:   map[uint32]struct{}{16777300: {}, 16777502: {}},
+		lastID:     16777300,
+		idStrategy: RangeStrategy{Min: 16777500, Max: 16777504},
+	}
+
+	var ids []uint32
+	for i := 0; i < 4; i++ {
+		id, err := driver.GetNextQuotaID()
+		if err != nil {
+			t.Fatalf("failed to get next quota id: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	if expect := []uint32{16777500, 16777501, 16777503, 16777504}; fmt.Sprint(ids) != fmt.Sprint(expect) {
+		t.Fatalf("expect quota ids %v, got %v", expect, ids)
+	}
+
+	// the range runs out.
+	if id, err := driver.GetNextQuotaID(); err == nil {
+		t.Fatalf("expect error when range runs out, got %d", id)
+	}
+}
+
+func Test_sequentialStrategy(t *testing.T) {
+	for _, tc := range []struct {
+		last   uint32
+		expect uint32
+		ok     bool
+	}{
+		{last: 0, expect: QuotaMinID + 1, ok: true},
+		{last: QuotaMinID + 10, expect: QuotaMinID + 11, ok: true},
+		{last: math.MaxUint32, ok: false},
+	} {
+		id, ok := sequentialStrategy{}.Next(tc.last)
+		if id != tc.expect || ok != tc.ok {
+			t.Fatalf("expect (%d, %v) after %d, got (%d, %v)", tc.expect, tc.ok, tc.last, id, ok)
+		}
+	}
+}
+
+func TestPrjQuotaQuotaIDCache(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+
+	driver := &PrjQuotaDriver{
+		quotaIDs: make(map[uint32]struct{}),
+		lastID:   QuotaMinID,
+	}
+	runner.attrs[dir] = fmt.Sprint(QuotaMinID + 1)
+
+	// the repeated reads within ttl are served by cache.
+	for i := 0; i < 3; i++ {
+		if id := driver.GetQuotaIDInFileAttr(dir); id != QuotaMinID+1 {
+			t.Fatalf("expect quota id %d, got %d", QuotaMinID+1, id)
+		}
+	}
+	if lsattr := runner.executed("lsattr"); len(lsattr) != 1 {
+		t.Fatalf("expect lsattr executed once, got %v", lsattr)
+	}
+
+	// the cache is dropped once driver changes the quota id.
+	if err := driver.SetQuotaIDInFileAttr(dir, QuotaMinID+2); err != nil {
+		t.Fatalf("failed to set quota id: %v", err)
+	}
+	if id := driver.GetQuotaIDInFileAttr(dir); id != QuotaMinID+2 {
+		t.Fatalf("expect quota id %d after change, got %d", QuotaMinID+2, id)
+	}
+	if err := driver.SetFileAttrRecursive(filepath.Dir(dir), QuotaMinID+3); err != nil {
+		t.Fatalf("failed to set quota id recursively: %v", err)
+	}
+	runner.attrs[dir] = fmt.Sprint(QuotaMinID + 3)
+	if id := driver.GetQuotaIDInFileAttr(dir); id != QuotaMinID+3 {
+		t.Fatalf("expect quota id %d after recursive change, got %d", QuotaMinID+3, id)
+	}
+	if lsattr := runner.executed("lsattr"); len(lsattr) != 3 {
+		t.Fatalf("expect lsattr executed after each change, got %v", lsattr)
+	}
+
+	// the cache expires after ttl.
+	originTTL := quotaIDCacheTTL
+	defer func() { quotaIDCacheTTL = originTTL }()
+	quotaIDCacheTTL = time.Millisecond
+	driver.invalidateQuotaID(dir, false)
+	driver.GetQuotaIDInFileAttr(dir)
+	time.Sleep(5 * time.Millisecond)
+	runner.attrs[dir] = fmt.Sprint(QuotaMinID + 4)
+	if id := driver.GetQuotaIDInFileAttr(dir); id != QuotaMinID+4 {
+		t.Fatalf("expect quota id %d after ttl, got %d", QuotaMinID+4, id)
+	}
+}
+
+func TestPrjQuotaSuspendResume(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+
+	driver := &PrjQuotaDriver{
+		quotaIDs: make(map[uint32]struct{}),
+		lastID:   QuotaMinID,
+	}
+	id := QuotaMinID + 1
+	runner.attrs[dir] = fmt.Sprint(id)
+
+	if err := driver.Resume(dir); err == nil {
+		t.Fatalf("expect error to resume quota which is not suspended")
+	}
+
+	report := func(soft, hard int) fakeResult {
+		return fakeResult{stdout: fmt.Sprintf("#0 -- 220 0 0 25 0 0\n#%d -- 4096 %d %d 9 0 0\n", id, soft, hard)}
+	}
+	runner.results["repquota"] = []fakeResult{report(8192, 10240)}
+	if err := driver.Suspend(dir); err != nil {
+		t.Fatalf("failed to suspend quota: %v", err)
+	}
+	if err := driver.Suspend(dir); err == nil {
+		t.Fatalf("expect error to suspend quota twice")
+	}
+
+	runner.results["repquota"] = []fakeResult{report(8192, 10240)}
+	if err := driver.Resume(dir); err != nil {
+		t.Fatalf("failed to resume quota: %v", err)
+	}
+	if err := driver.Resume(dir); err == nil {
+		t.Fatalf("expect error to resume quota twice")
+	}
+
+	setquota := runner.executed("setquota")
+	if len(setquota) != 2 {
+		t.Fatalf("expect setquota executed twice, got %v", setquota)
+	}
+	if got := strings.Join(setquota[0][2:6], " "); got != fmt.Sprintf("%d 0 0 0", id) {
+		t.Fatalf("expect limit cleared on suspend, got %v", setquota[0])
+	}
+	if got := strings.Join(setquota[1][2:6], " "); got != fmt.Sprintf("%d 8192 10240 0", id) {
+		t.Fatalf("expect original limits restored on resume, got %v", setquota[1])
+	}
+}
+
+func TestPrjQuotaSuspendConcurrent(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+
+	driver := &PrjQuotaDriver{
+		quotaIDs: make(map[uint32]struct{}),
+		lastID:   QuotaMinID,
+	}
+	id := QuotaMinID + 1
+	runner.attrs[dir] = fmt.Sprint(id)
+
+	const n = 8
+	for i := 0; i < n; i++ {
+		runner.results["repquota"] = append(runner.results["repquota"],
+			fakeResult{stdout: fmt.Sprintf("#%d -- 4096 8192 10240 9 0 0\n", id)})
+	}
+
+	// repquota takes a while, so that the concurrent calls interleave without the lock,
+	// and the lock of quota id pool is not held across it.
+	var blocked int32
+	execRun = func(timeout time.Duration, bin string, args ...string) (int, string, string, error) {
+		if bin == "repquota" {
+			locked := make(chan struct{})
+			go func() {
+				driver.lock.Lock()
+				driver.lock.Unlock()
+				close(locked)
+			}()
+			select {
+			case <-locked:
+			case <-time.After(time.Second):
+				atomic.AddInt32(&blocked, 1)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return runner.run(timeout, bin, args...)
+	}
+
+	var (
+		wg        sync.WaitGroup
+		succeeded int32
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := driver.Suspend(dir); err == nil {
+				atomic.AddInt32(&succeeded, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if succeeded != 1 {
+		t.Fatalf("expect quota suspended once, got %d", succeeded)
+	}
+	if blocked != 0 {
+		t.Fatalf("expect lock of quota id pool not held across repquota, blocked %d times", blocked)
+	}
+	if setquota := runner.executed("setquota"); len(setquota) != 1 {
+		t.Fatalf("expect setquota executed once, got %v", setquota)
+	}
+}
+
+func TestPrjQuotaSetQuotaIDConflict(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+
+	oldID, newID := QuotaMinID+1, QuotaMinID+2
+
+	// reject the quota id which differs from the one in file attr.
+	driver := NewQuotaDriver("prjquota", WithQuotaIDConflictError()).(*PrjQuotaDriver)
+	runner.attrs[dir] = fmt.Sprint(oldID)
+	if _, err := driver.SetDiskQuotaWithResult(dir, "1m", newID); errors.Cause(err) != ErrQuotaIDConflict {
+		t.Fatalf("expect ErrQuotaIDConflict, got %v", err)
+	}
+	if chattr := runner.executed("chattr"); len(chattr) != 0 {
+		t.Fatalf("expect no chattr on conflict, got %v", chattr)
+	}
+	if got := driver.GetQuotaIDInFileAttr(dir); got != oldID {
+		t.Fatalf("expect quota id %d kept on conflict, got %d", oldID, got)
+	}
+
+	// the same quota id is not a conflict.
+	if _, err := driver.SetDiskQuotaWithResult(dir, "1m", oldID); err != nil {
+		t.Fatalf("failed to set the same quota id: %v", err)
+	}
+
+	// reassign the requested quota id recursively by default.
+	runner.commands = nil
+	driver = &PrjQuotaDriver{
+		quotaIDs: make(map[uint32]struct{}),
+		lastID:   QuotaMinID,
+	}
+	result, err := driver.SetDiskQuotaWithResult(dir, "1m", newID)
+	if err != nil {
+		t.Fatalf("failed to reassign quota id: %v", err)
+	}
+	if result.QuotaID != newID || driver.GetQuotaIDInFileAttr(dir) != newID {
+		t.Fatalf("expect quota id reassigned to %d, got %d", newID, result.QuotaID)
+	}
+	chattr := runner.executed("chattr")
+	if len(chattr) != 1 || strings.Join(chattr[0], " ") != fmt.Sprintf("chattr -R -p %d +P %s", newID, dir) {
+		t.Fatalf("expect quota id reassigned recursively, got %v", chattr)
+	}
+}
+
+func TestPrjQuotaSetFileAttrInheritOnly(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatalf("failed to create dir: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := ioutil.WriteFile(filepath.Join(sub, fmt.Sprint(i)), nil, 0644); err != nil {
+			t.Fatalf("failed to create file: %v", err)
+		}
+	}
+
+	// the existing sub directories are set with inherit flag too, but not the regular files.
+	id := QuotaMinID + 1
+	driver := NewQuotaDriver("prjquota", WithInheritOnlyThreshold(2)).(*PrjQuotaDriver)
+	if err := driver.SetFileAttrRecursive(dir, id); err != nil {
+		t.Fatalf("failed to set quota id: %v", err)
+	}
+	chattr := runner.executed("chattr")
+	if len(chattr) != 1 || strings.Join(chattr[0], " ") != fmt.Sprintf("chattr -p %d +P %s %s", id, dir, sub) {
+		t.Fatalf("expect quota id set on directories with inherit flag only, got %v", chattr)
+	}
+
+	// the small tree is still set recursively.
+	runner.commands = nil
+	driver = NewQuotaDriver("prjquota", WithInheritOnlyThreshold(3)).(*PrjQuotaDriver)
+	if err := driver.SetFileAttrRecursive(dir, id); err != nil {
+		t.Fatalf("failed to set quota id: %v", err)
+	}
+	chattr = runner.executed("chattr")
+	if len(chattr) != 1 || strings.Join(chattr[0], " ") != fmt.Sprintf("chattr -R -p %d +P %s", id, dir) {
+		t.Fatalf("expect quota id set recursively, got %v", chattr)
+	}
+}
+
+func Test_countFiles(t *testing.T) {
+	dir, clean := newTestDir(t)
+	defer clean()
+
+	if err := os.MkdirAll(filepath.Join(dir, "a", "b"), 0755); err != nil {
+		t.Fatalf("failed to create dir: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "a", "b", "c"), nil, 0644); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	if got := countFiles(dir, 10); got != 3 {
+		t.Fatalf("expect 3 files, got %d", got)
+	}
+	if got := countFiles(dir, 1); got != 2 {
+		t.Fatalf("expect counting to stop at 2 files, got %d", got)
+	}
+}
+
+func TestPrjQuotaEnforceQuotaExt2(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+
+	devID, err := getDevID(dir)
+	if err != nil {
+		t.Fatalf("failed to get dev id of %s: %v", dir, err)
+	}
+
+	f, err := ioutil.TempFile("", "quota-mounts")
+	if err != nil {
+		t.Fatalf("failed to create mounts fixture: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(fmt.Sprintf("/dev/sdb1 %s ext2 rw,relatime 0 0\n", dir)); err != nil {
+		t.Fatalf("failed to write mounts fixture: %v", err)
+	}
+	f.Close()
+
+	originFile, originDevID := procMountFile, mountDevID
+	defer func() {
+		procMountFile, mountDevID = originFile, originDevID
+	}()
+	procMountFile = f.Name()
+	mountDevID = func(mp string) (uint64, error) {
+		if mp == dir {
+			return devID, nil
+		}
+		return 0, nil
+	}
+
+	driver := &PrjQuotaDriver{
+		quotaIDs: make(map[uint32]struct{}),
+		lastID:   QuotaMinID,
+	}
+
+	// ext2 formatted without project feature.
+	runner.results["tune2fs"] = []fakeResult{{stdout: "Filesystem features:      ext_attr resize_inode dir_index filetype sparse_super\n"}}
+	if _, err := driver.EnforceQuota(dir); err == nil || !strings.Contains(err.Error(), "ext2 may not support project quota") {
+		t.Fatalf("expect error of ext2 without project feature, got %v", err)
+	}
+	if mount := runner.executed("mount"); len(mount) != 0 {
+		t.Fatalf("expect no remount without project feature, got %v", mount)
+	}
+
+	// ext2 with project feature takes the ext4 code path.
+	mountInfo, err := driver.EnforceQuota(dir)
+	if err != nil {
+		t.Fatalf("failed to enforce quota on ext2: %v", err)
+	}
+	if mountInfo.MountPoint != dir || mountInfo.FsType != "ext2" {
+		t.Fatalf("expect mount info of ext2 on %s, got %+v", dir, mountInfo)
+	}
+	mount := runner.executed("mount")
+	if len(mount) != 1 || mount[0][2] != "remount,rw,relatime,prjquota" {
+		t.Fatalf("expect ext2 remounted with prjquota, got %v", mount)
+	}
+	if quotaon := runner.executed("quotaon"); len(quotaon) != 1 {
+		t.Fatalf("expect quotaon executed, got %v", quotaon)
+	}
+}
+
+func TestPrjQuotaSetDiskQuotaDenied(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+
+	// the container rootfs path resolves to the host root.
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.Symlink("/", rootfs); err != nil {
+		t.Fatalf("failed to create symlink: %v", err)
+	}
+	denied := filepath.Join(dir, "denied")
+	if err := os.Mkdir(denied, 0755); err != nil {
+		t.Fatalf("failed to create denied dir: %v", err)
+	}
+
+	driver := &PrjQuotaDriver{
+		quotaIDs: make(map[uint32]struct{}),
+		lastID:   QuotaMinID,
+		denyDirs: []string{denied},
+	}
+	for _, d := range []string{"/", rootfs, denied, denied + "/."} {
+		if _, err := driver.SetDiskQuotaWithResult(d, "1m", 0); errors.Cause(err) != ErrQuotaDirDenied {
+			t.Fatalf("expect ErrQuotaDirDenied for %s, got %v", d, err)
+		}
+	}
+	if len(runner.commands) != 0 {
+		t.Fatalf("expect no quota command executed for denied dirs, got %v", runner.commands)
+	}
+
+	if _, err := driver.SetDiskQuotaWithResult(dir, "1m", 0); err != nil {
+		t.Fatalf("failed to set disk quota on allowed dir: %v", err)
+	}
+
+	if got := NewQuotaDriver("prjquota", WithDenyDirs(denied)).(*PrjQuotaDriver).denyDirs; len(got) != 1 || got[0] != denied {
+		t.Fatalf("expect deny dirs [%s], got %v", denied, got)
+	}
+}
+
+func TestPrjQuotaDebugState(t *testing.T) {
+	_, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+
+	devID, err := getDevID(dir)
+	if err != nil {
+		t.Fatalf("failed to get dev id of %s: %v", dir, err)
+	}
+
+	driver := &PrjQuotaDriver{
+		quotaIDs: make(map[uint32]struct{}),
+		lastID:   QuotaMinID,
+	}
+	if state := driver.DebugState(); state.AllocatedIDs != 0 || len(state.QuotaDirs) != 0 || len(state.Devices) != 0 {
+		t.Fatalf("expect empty state, got %+v", state)
+	}
+
+	result, err := driver.SetDiskQuotaWithResult(dir, "1m", 0)
+	if err != nil {
+		t.Fatalf("failed to set disk quota: %v", err)
+	}
+
+	state := driver.DebugState()
+	if state.AllocatedIDs != 1 || state.QuotaDirs[result.QuotaID] != dir {
+		t.Fatalf("expect quota id %d allocated for %s, got %+v", result.QuotaID, dir, state)
+	}
+	if state.LastID < result.QuotaID || len(state.FreeIDs) != freeIDBatch-1 {
+		t.Fatalf("expect last id and free ids after allocation, got %+v", state)
+	}
+	if len(state.AppliedDirs) != 1 || state.AppliedDirs[0] != dir {
+		t.Fatalf("expect applied dirs [%s], got %v", dir, state.AppliedDirs)
+	}
+	if len(state.Devices) != 1 || state.Devices[0] != devID {
+		t.Fatalf("expect devices [%d], got %v", devID, state.Devices)
+	}
+
+	// the snapshot never exposes the live state of driver.
+	state.QuotaDirs[result.QuotaID] = "/changed"
+	state.FreeIDs[0] = 0
+	again := driver.DebugState()
+	if again.QuotaDirs[result.QuotaID] != dir || again.FreeIDs[0] == 0 {
+		t.Fatalf("expect driver state unchanged by snapshot, got %+v", again)
+	}
+}
+
+func TestPrjQuotaFreeIDCount(t *testing.T) {
+	driver := &PrjQuotaDriver{
+		quotaIDs:   map[uint32]struct{}{QuotaMinID + 3: {}, QuotaMinID + 100: {}},
+		lastID:     QuotaMinID,
+		idStrategy: RangeStrategy{Min: QuotaMinID + 1, Max: QuotaMinID + 10},
+	}
+
+	// the quota id in use out of range is not counted.
+	if count := driver.FreeIDCount(); count != 9 {
+		t.Fatalf("expect 9 free quota ids, got %d", count)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := driver.GetNextQuotaID(); err != nil {
+			t.Fatalf("failed to get next quota id: %v", err)
+		}
+	}
+	if count := driver.FreeIDCount(); count != 6 {
+		t.Fatalf("expect 6 free quota ids after 3 allocations, got %d", count)
+	}
+
+	// the ids after QuotaMinID are counted by default.
+	driver = &PrjQuotaDriver{
+		quotaIDs: make(map[uint32]struct{}),
+		lastID:   QuotaMinID,
+	}
+	if _, err := driver.GetNextQuotaID(); err != nil {
+		t.Fatalf("failed to get next quota id: %v", err)
+	}
+	if count := driver.FreeIDCount(); count != uint64(math.MaxUint32-QuotaMinID)-1 {
+		t.Fatalf("expect %d free quota ids, got %d", uint64(math.MaxUint32-QuotaMinID)-1, count)
+	}
+
+	// the range is taken from the pointer of RangeStrategy as well.
+	driver = &PrjQuotaDriver{
+		quotaIDs:   map[uint32]struct{}{QuotaMinID + 1: {}},
+		lastID:     QuotaMinID,
+		idStrategy: &RangeStrategy{Min: QuotaMinID + 1, Max: QuotaMinID + 10},
+	}
+	if count := driver.FreeIDCount(); count != 9 {
+		t.Fatalf("expect 9 free quota ids in range of *RangeStrategy, got %d", count)
+	}
+}
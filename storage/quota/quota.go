@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 	"syscall"
@@ -24,13 +25,52 @@ const (
 	// The value is unit32(2^24).
 	QuotaMinID = uint32(16777216)
 
-	// procMountFile represent the mounts file in proc virtual file system.
-	procMountFile = "/proc/mounts"
+	// defaultRemountRetries is the default retry times of remount when filesystem is busy.
+	defaultRemountRetries = 3
 )
 
 var (
+	// procMountFile represent the mounts file in proc virtual file system,
+	// it is replaced in unit test.
+	procMountFile = "/proc/mounts"
+
+	// mountDevID is used to get the device id of mountpoint, it is replaced in unit test.
+	mountDevID = system.GetDevID
+
+	// deviceRdev is used to get the device number of device node, it is replaced in unit test.
+	deviceRdev = getDeviceRdev
+
 	// GQuotaDriver represents global quota driver.
 	GQuotaDriver = NewQuotaDriver("")
+
+	// tmpfsQuotaDriver is used for the directory which lies on tmpfs.
+	tmpfsQuotaDriver BaseQuota = &TmpfsQuotaDriver{}
+
+	// execRun is used to run the quota tools, it is replaced in unit test.
+	execRun = exec.Run
+
+	// statfs is used to get filesystem statistics, it is replaced in unit test.
+	statfs = syscall.Statfs
+
+	// hostRootDir is the root directory of host, it is replaced in unit test.
+	hostRootDir = "/"
+
+	// remountRetryInterval is the interval between retries of remount.
+	remountRetryInterval = 500 * time.Millisecond
+
+	// ErrQuotaIDInUse represents the quota id is already bound to another directory.
+	ErrQuotaIDInUse = errors.New("quota id is in use")
+
+	// ErrQuotaIDConflict represents the directory already holds another quota id.
+	ErrQuotaIDConflict = errors.New("quota id conflicts with the one in file attr")
+
+	// ErrQuotaDirDenied represents the directory is the host root filesystem or in the deny list,
+	// on which quota is never applied.
+	ErrQuotaDirDenied = errors.New("quota is not allowed on the directory")
+
+	// ErrOverlayNotSupported represents the directory lies on overlay filesystem,
+	// which supports neither project nor group quota.
+	ErrOverlayNotSupported = errors.New("quota is not supported on overlay filesystem")
 )
 
 // BaseQuota defines the quota operation interface.
@@ -44,6 +84,10 @@ type BaseQuota interface {
 	// * quota ID: an ID represent quota attr which is used in the global scope.
 	SetDiskQuota(dir string, size string, quotaID uint32) error
 
+	// SetDiskQuotaWithResult works as SetDiskQuota, and returns the quota ID,
+	// mountpoint and filesystem type which are actually used.
+	SetDiskQuotaWithResult(dir string, size string, quotaID uint32) (*SetQuotaResult, error)
+
 	// CheckMountpoint is used to check mount point.
 	// It returns mointpoint, enable quota and filesystem type of the device.
 	CheckMountpoint(devID uint64) (string, bool, string)
@@ -61,29 +105,160 @@ type BaseQuota interface {
 
 	// SetFileAttrRecursive set the file attr by recursively.
 	SetFileAttrRecursive(dir string, quotaID uint32) error
+
+	// GetDiskQuota returns the disk usage and limit of the quota which directory belongs to.
+	GetDiskQuota(dir string) (*QuotaUsage, error)
+}
+
+// driverOpts defines the options of quota driver.
+type driverOpts struct {
+	stateDir       string
+	remountRetries int
+	remountOptions []string
+	rejectConflict bool
+	denyDirs       []string
+	inheritFiles   int
+	tools          toolPaths
+	audit          AuditSink
+	idStrategy     IDStrategy
+}
+
+// Opt is used to modify the quota driver setting.
+type Opt func(*driverOpts)
+
+// WithStateDir sets the directory to store quota state, such as the quota id journal.
+// The directory is created if missing, and it should only be accessed by root.
+func WithStateDir(dir string) Opt {
+	return func(o *driverOpts) {
+		o.stateDir = dir
+	}
+}
+
+// WithRemountRetries sets the max retry times of remount when filesystem is busy.
+func WithRemountRetries(retries int) Opt {
+	return func(o *driverOpts) {
+		if retries >= 0 {
+			o.remountRetries = retries
+		}
+	}
+}
+
+// WithRemountOptions sets the comma separated options, such as "usrquota", which are
+// appended to the existing mount options when the mountpoint is remounted with prjquota.
+func WithRemountOptions(options string) Opt {
+	return func(o *driverOpts) {
+		o.remountOptions = nil
+		for _, opt := range strings.Split(options, ",") {
+			if opt = strings.TrimSpace(opt); opt != "" {
+				o.remountOptions = append(o.remountOptions, opt)
+			}
+		}
+	}
+}
+
+// WithQuotaIDConflictError makes project quota driver return ErrQuotaIDConflict when the
+// quota id requested for a directory differs from the one it holds, by default the
+// requested quota id is reassigned to the directory and the files in it recursively.
+func WithQuotaIDConflictError() Opt {
+	return func(o *driverOpts) {
+		o.rejectConflict = true
+	}
+}
+
+// WithDenyDirs sets the directories which quota is never applied on, besides the host
+// root filesystem, such as the mountpoints of system devices.
+func WithDenyDirs(dirs ...string) Opt {
+	return func(o *driverOpts) {
+		o.denyDirs = append(o.denyDirs, dirs...)
+	}
+}
+
+// WithInheritOnlyThreshold makes project quota driver set the quota id only on the directories
+// with the inherit flag, instead of on every file, if the directory holds more files than the
+// threshold, since setting it on every file of a huge tree is slow. The files created later in
+// any directory inherit the quota id, but the pre-existing regular files keep their own and are
+// not accounted in the quota until they are re-created. 0 means always on every file.
+func WithInheritOnlyThreshold(files int) Opt {
+	return func(o *driverOpts) {
+		if files >= 0 {
+			o.inheritFiles = files
+		}
+	}
+}
+
+// WithToolPath sets the path of quota tool, such as mount, quotaon, setquota,
+// repquota, chattr, lsattr, tune2fs, getfattr and setfattr. The tool is looked
+// up in PATH if its path is not set.
+func WithToolPath(tool, path string) Opt {
+	return func(o *driverOpts) {
+		if o.tools == nil {
+			o.tools = make(toolPaths)
+		}
+		o.tools[tool] = path
+	}
+}
+
+// newDriverOpts returns the driver options with defaults modified by opts.
+func newDriverOpts(opts ...Opt) *driverOpts {
+	o := &driverOpts{
+		stateDir:       DefaultStateDir,
+		remountRetries: defaultRemountRetries,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
 }
 
 // NewQuotaDriver returns a quota instance.
-func NewQuotaDriver(name string) BaseQuota {
+func NewQuotaDriver(name string, opts ...Opt) BaseQuota {
+	o := newDriverOpts(opts...)
+
 	var quota BaseQuota
 	switch name {
 	case "grpquota":
 		quota = &GrpQuotaDriver{
 			quotaIDs: make(map[uint32]struct{}),
+			journal:  newIDJournal(o.stateDir),
+			denyDirs: o.denyDirs,
+			tools:    o.tools,
+			audit:    o.audit,
 		}
 	case "prjquota":
 		quota = &PrjQuotaDriver{
-			quotaIDs: make(map[uint32]struct{}),
+			quotaIDs:       make(map[uint32]struct{}),
+			journal:        newIDJournal(o.stateDir),
+			remountRetries: o.remountRetries,
+			remountOptions: o.remountOptions,
+			rejectConflict: o.rejectConflict,
+			denyDirs:       o.denyDirs,
+			inheritFiles:   o.inheritFiles,
+			tools:          o.tools,
+			audit:          o.audit,
+			idStrategy:     o.idStrategy,
 		}
 	default:
 		kernelVersion, err := kernel.GetKernelVersion()
 		if err == nil && kernelVersion.Kernel >= 4 {
 			quota = &PrjQuotaDriver{
-				quotaIDs: make(map[uint32]struct{}),
+				quotaIDs:       make(map[uint32]struct{}),
+				journal:        newIDJournal(o.stateDir),
+				remountRetries: o.remountRetries,
+				remountOptions: o.remountOptions,
+				rejectConflict: o.rejectConflict,
+				denyDirs:       o.denyDirs,
+				inheritFiles:   o.inheritFiles,
+				tools:          o.tools,
+				audit:          o.audit,
+				idStrategy:     o.idStrategy,
 			}
 		} else {
 			quota = &GrpQuotaDriver{
 				quotaIDs: make(map[uint32]struct{}),
+				journal:  newIDJournal(o.stateDir),
+				denyDirs: o.denyDirs,
+				tools:    o.tools,
+				audit:    o.audit,
 			}
 		}
 	}
@@ -92,18 +267,127 @@ func NewQuotaDriver(name string) BaseQuota {
 }
 
 // SetQuotaDriver is used to set global quota driver.
-func SetQuotaDriver(name string) {
-	GQuotaDriver = NewQuotaDriver(name)
+func SetQuotaDriver(name string, opts ...Opt) {
+	GQuotaDriver = NewQuotaDriver(name, opts...)
+	o := newDriverOpts(opts...)
+	tmpfsQuotaDriver = &TmpfsQuotaDriver{tools: o.tools, denyDirs: o.denyDirs}
 }
 
 // SetDiskQuota is used to set quota for directory.
 func SetDiskQuota(dir string, size string, quotaID uint32) error {
-	log.With(nil).Infof("set disk quota, dir(%s), size(%s), quotaID(%d)", dir, size, quotaID)
+	log.WithFields(nil, map[string]interface{}{"dir": dir, "quotaID": quotaID}).Infof("set disk quota, size(%s)", size)
 	if isRegular, err := CheckRegularFile(dir); err != nil || !isRegular {
-		log.With(nil).Debugf("set quota skip not regular file: %s", dir)
+		log.WithFields(nil, map[string]interface{}{"dir": dir}).Debugf("set quota skip not regular file")
 		return err
 	}
-	return GQuotaDriver.SetDiskQuota(dir, size, quotaID)
+	return getSetQuotaDriver(dir).SetDiskQuota(dir, size, quotaID)
+}
+
+// SetDiskQuotaWithResult is used to set quota for directory,
+// it returns the quota ID, mountpoint and filesystem type which are actually used.
+func SetDiskQuotaWithResult(dir string, size string, quotaID uint32) (*SetQuotaResult, error) {
+	log.WithFields(nil, map[string]interface{}{"dir": dir, "quotaID": quotaID}).Infof("set disk quota, size(%s)", size)
+	if isRegular, err := CheckRegularFile(dir); err != nil || !isRegular {
+		log.WithFields(nil, map[string]interface{}{"dir": dir}).Debugf("set quota skip not regular file")
+		return nil, err
+	}
+	return getSetQuotaDriver(dir).SetDiskQuotaWithResult(dir, size, quotaID)
+}
+
+// getQuotaDriver returns the quota driver for directory,
+// tmpfs uses TmpfsQuotaDriver since it supports neither project nor group quota,
+// and the directory polled by the fallback driver keeps using it.
+func getQuotaDriver(dir string) BaseQuota {
+	if getMountpointFstype(dir) == "tmpfs" {
+		return tmpfsQuotaDriver
+	}
+	if pollingFallback != nil && pollingFallback.polled(dir) {
+		return pollingFallback
+	}
+	return GQuotaDriver
+}
+
+// quotaProber is implemented by the kernel quota driver, to check whether quota can be
+// enforced on directory without side effect.
+type quotaProber interface {
+	probeQuota(dir string) error
+}
+
+// quotaReleaser is implemented by the quota driver which allocates quota id, to return
+// the quota id allocated for directory to the free ones.
+type quotaReleaser interface {
+	releaseQuotaID(dir string, id uint32)
+
+	// releaseDirQuota clears the limit of the quota id of directory and releases it.
+	releaseDirQuota(dir string) error
+}
+
+// releaseQuotaID returns the quota id allocated for directory to the driver, it does
+// nothing if the driver does not allocate quota id.
+func releaseQuotaID(dir string, id uint32) {
+	if releaser, ok := GQuotaDriver.(quotaReleaser); ok && id != 0 {
+		releaser.releaseQuotaID(dir, id)
+	}
+}
+
+// getSetQuotaDriver returns the quota driver to set quota for directory, it falls
+// back to the polling quota driver if set, when kernel quota can not be enforced.
+func getSetQuotaDriver(dir string) BaseQuota {
+	driver := getQuotaDriver(dir)
+	if driver != GQuotaDriver || pollingFallback == nil {
+		return driver
+	}
+	prober, ok := GQuotaDriver.(quotaProber)
+	if !ok {
+		return driver
+	}
+	// overlay is refused rather than polled, since the usage of merged dir is misleading.
+	if err := prober.probeQuota(dir); err != nil && errors.Cause(err) != ErrOverlayNotSupported {
+		log.WithFields(nil, map[string]interface{}{"dir": dir}).
+			Warnf("failed to enforce kernel quota, fall back to polling quota, err(%v)", err)
+		return pollingFallback
+	}
+	return driver
+}
+
+// getMountpointFstype returns the filesystem type of the device on which directory lies,
+// it returns empty string if failure happens.
+func getMountpointFstype(dir string) string {
+	devID, err := getDevID(dir)
+	if err != nil {
+		log.WithFields(nil, map[string]interface{}{"dir": dir}).Warnf("failed to get device id, err(%v)", err)
+		return ""
+	}
+	_, _, fsType := GQuotaDriver.CheckMountpoint(devID)
+	return fsType
+}
+
+// GetDiskQuota returns the disk usage and limit of the quota which directory belongs to.
+func GetDiskQuota(dir string) (*QuotaUsage, error) {
+	return getQuotaDriver(dir).GetDiskQuota(dir)
+}
+
+// GetDiskQuotaReport returns the quota usage of directory and the space of the filesystem
+// which directory lies on, it is used to tell whether the quota or the filesystem is full
+// when a write fails.
+func GetDiskQuotaReport(dir string) (*DiskQuotaReport, error) {
+	usage, err := GetDiskQuota(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get disk quota of dir(%s)", dir)
+	}
+
+	var stfs syscall.Statfs_t
+	if err := statfs(dir, &stfs); err != nil {
+		return nil, errors.Wrapf(err, "failed to statfs dir(%s)", dir)
+	}
+	blockSize := devBlockSize(&stfs)
+
+	return &DiskQuotaReport{
+		Quota:   usage,
+		FsSize:  stfs.Blocks * blockSize,
+		FsFree:  stfs.Bfree * blockSize,
+		FsAvail: stfs.Bavail * blockSize,
+	}, nil
 }
 
 // CheckMountpoint is used to check mount point.
@@ -144,6 +428,16 @@ func SetRootfsDiskQuota(basefs, size string, quotaID uint32, update bool) (uint3
 	}
 
 	for _, dir := range []string{overlayMountInfo.Upper, overlayMountInfo.Work} {
+		// tmpfs and polling quota have no quota id, the size is set on the whole
+		// mount or polled.
+		driver := getSetQuotaDriver(dir)
+		if driver != GQuotaDriver {
+			if err := driver.SetDiskQuota(dir, size, 0); err != nil {
+				return 0, errors.Wrapf(err, "failed to set dir(%s) disk quota", dir)
+			}
+			continue
+		}
+
 		if quotaID == 0 {
 			quotaID, err = GetQuotaID(dir)
 			if err != nil {
@@ -151,13 +445,70 @@ func SetRootfsDiskQuota(basefs, size string, quotaID uint32, update bool) (uint3
 			}
 		}
 
-		if err := SetDiskQuota(dir, size, quotaID); err != nil {
+		if err := driver.SetDiskQuota(dir, size, quotaID); err != nil {
 			return 0, errors.Wrapf(err, "failed to set dir(%s) disk quota", dir)
 		}
 
 		if update {
-			go SetFileAttrRecursive(dir, quotaID)
-		} else if err := SetFileAttrRecursive(dir, quotaID); err != nil {
+			go driver.SetFileAttrRecursive(dir, quotaID)
+		} else if err := driver.SetFileAttrRecursive(dir, quotaID); err != nil {
+			return 0, errors.Wrapf(err, "failed to set dir(%s) quota recursively", dir)
+		}
+	}
+
+	return quotaID, nil
+}
+
+// VerifyRootfsQuota verifies the quota id of container rootfs before container starts.
+// SetRootfsDiskQuota sets the quota id on the upper and work dirs at create time, but
+// the file attr may be lost since then, such as the snapshot is copied or restored
+// by other tools. The dir which lost its quota id is re-applied with quotaID and size.
+// If quotaID is 0, the quota id in the file attr of the first dir is expected, and a
+// new one is allocated if both dirs lost it. The dir which quota can not be enforced on
+// is skipped. It returns the quota id in effect.
+func VerifyRootfsQuota(upperDir, workDir, size string, quotaID uint32) (uint32, error) {
+	var err error
+	for _, dir := range []string{upperDir, workDir} {
+		// tmpfs and polling quota have no quota id, the size is kept by the mount or polled.
+		if dir == "" || getQuotaDriver(dir) != GQuotaDriver {
+			continue
+		}
+
+		id := GetQuotaIDInFileAttr(dir)
+		if quotaID == 0 {
+			quotaID = id
+		}
+		if id != 0 && id == quotaID {
+			continue
+		}
+
+		// no quota id is allocated for the dir which quota can not be enforced on.
+		if prober, ok := GQuotaDriver.(quotaProber); ok {
+			if err := prober.probeQuota(dir); err != nil {
+				log.WithFields(nil, map[string]interface{}{"dir": dir}).
+					Debugf("skip to verify quota, quota can not be enforced, err(%v)", err)
+				continue
+			}
+		}
+
+		var allocated bool
+		if quotaID == 0 {
+			quotaID, err = GetNextQuotaID()
+			if err != nil {
+				return 0, errors.Wrapf(err, "failed to get dir(%s) quota id", dir)
+			}
+			allocated = true
+		}
+
+		log.WithFields(nil, map[string]interface{}{"dir": dir, "quotaID": quotaID}).
+			Warnf("quota id(%d) in file attr mismatches, re-apply disk quota, size(%s)", id, size)
+		if err := SetDiskQuota(dir, size, quotaID); err != nil {
+			if allocated {
+				releaseQuotaID(dir, quotaID)
+			}
+			return 0, errors.Wrapf(err, "failed to set dir(%s) disk quota", dir)
+		}
+		if err := SetFileAttrRecursive(dir, quotaID); err != nil {
 			return 0, errors.Wrapf(err, "failed to set dir(%s) quota recursively", dir)
 		}
 	}
@@ -165,16 +516,180 @@ func SetRootfsDiskQuota(basefs, size string, quotaID uint32, update bool) (uint3
 	return quotaID, nil
 }
 
+// SetLogDirQuota is to set container log dir disk quota with its own quota id,
+// so the logs are limited separately from the rootfs. rootfsQuotaID is the quota
+// id of container rootfs, the log dir never shares it even if the log dir lies on
+// the same device as rootfs. If the log dir lies on tmpfs, the size is set on the
+// whole mount and 0 is returned.
+func SetLogDirQuota(logDir, size string, rootfsQuotaID uint32) (uint32, error) {
+	if getMountpointFstype(logDir) == "tmpfs" {
+		if err := tmpfsQuotaDriver.SetDiskQuota(logDir, size, 0); err != nil {
+			return 0, errors.Wrapf(err, "failed to set log dir(%s) disk quota", logDir)
+		}
+		return 0, nil
+	}
+
+	// the log dir may inherit the rootfs quota id from its parent, allocate
+	// a new one in that case.
+	quotaID := GetQuotaIDInFileAttr(logDir)
+	if quotaID == 0 || quotaID == rootfsQuotaID {
+		id, err := GetNextQuotaID()
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to get log dir(%s) quota id", logDir)
+		}
+		quotaID = id
+	}
+
+	if err := SetDiskQuota(logDir, size, quotaID); err != nil {
+		return 0, errors.Wrapf(err, "failed to set log dir(%s) disk quota", logDir)
+	}
+
+	// log files are appended in place, so the existed ones need the quota id too.
+	if err := SetFileAttrRecursive(logDir, quotaID); err != nil {
+		return 0, errors.Wrapf(err, "failed to set log dir(%s) quota recursively", logDir)
+	}
+
+	return quotaID, nil
+}
+
+// SetVolumeQuota is to set volume disk quota with the volume's own quota id,
+// so the volume is limited as a whole no matter how many containers share it.
+// The quota id is kept in the file attr of volume directory and reused by the
+// later calls. If the volume lies on tmpfs, the size is set on the whole mount
+// and 0 is returned.
+func SetVolumeQuota(dir, size string) (uint32, error) {
+	if getMountpointFstype(dir) == "tmpfs" {
+		if err := tmpfsQuotaDriver.SetDiskQuota(dir, size, 0); err != nil {
+			return 0, errors.Wrapf(err, "failed to set volume(%s) disk quota", dir)
+		}
+		return 0, nil
+	}
+
+	// the volume dir may inherit the quota id from its parent, such as the
+	// volume is created in container rootfs, allocate a new one in that case.
+	prevID := GetQuotaIDInFileAttr(dir)
+	quotaID := prevID
+	if quotaID == 0 || quotaID == GetQuotaIDInFileAttr(path.Dir(dir)) {
+		id, err := GetNextQuotaID()
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to get volume(%s) quota id", dir)
+		}
+		quotaID = id
+	}
+
+	if err := SetDiskQuota(dir, size, quotaID); err != nil {
+		return 0, errors.Wrapf(err, "failed to set volume(%s) disk quota", dir)
+	}
+
+	// the volume may be populated before its own quota id is set, the files are
+	// reassigned by driver if the volume holds the inherited quota id.
+	if prevID == 0 {
+		if err := SetFileAttrRecursive(dir, quotaID); err != nil {
+			return 0, errors.Wrapf(err, "failed to set volume(%s) quota recursively", dir)
+		}
+	}
+
+	return quotaID, nil
+}
+
+// ReleaseVolumeQuota clears the quota of volume set by SetVolumeQuota and releases its
+// quota id, so that the quota id could be allocated again. It should be called before
+// the volume directory is removed. The quota id inherited from the parent is left as is.
+func ReleaseVolumeQuota(dir string) error {
+	if getQuotaDriver(dir) != GQuotaDriver {
+		return nil
+	}
+	releaser, ok := GQuotaDriver.(quotaReleaser)
+	if !ok {
+		return nil
+	}
+
+	id := GetQuotaIDInFileAttr(dir)
+	if id == 0 || id == GetQuotaIDInFileAttr(path.Dir(dir)) {
+		return nil
+	}
+	return releaser.releaseDirQuota(dir)
+}
+
+// ReleaseRootfsQuota clears the quota of container rootfs set by SetRootfsDiskQuota and
+// releases its quota id, so that the quota id could be allocated again. It should be
+// called before the upper and work dirs are removed.
+func ReleaseRootfsQuota(upperDir, workDir string) error {
+	releaser, ok := GQuotaDriver.(quotaReleaser)
+	if !ok {
+		return nil
+	}
+
+	released := make(map[uint32]struct{})
+	for _, dir := range []string{upperDir, workDir} {
+		// tmpfs and polling quota have no quota id.
+		if dir == "" || getQuotaDriver(dir) != GQuotaDriver {
+			continue
+		}
+		id := GetQuotaIDInFileAttr(dir)
+		if id == 0 {
+			continue
+		}
+		if _, ok := released[id]; ok {
+			continue
+		}
+		if err := releaser.releaseDirQuota(dir); err != nil {
+			return errors.Wrapf(err, "failed to release dir(%s) quota", dir)
+		}
+		released[id] = struct{}{}
+	}
+	return nil
+}
+
 // SetFileAttrRecursive set the file attr by recursively.
 func SetFileAttrRecursive(dir string, quotaID uint32) error {
 	return GQuotaDriver.SetFileAttrRecursive(dir, quotaID)
 }
 
+// PrepareQuotaDir sets quota id on an empty directory before it is populated,
+// so that all files written into it later are accounted from the start.
+//
+// On ext4, `chattr -p $ID +P $DIR` assigns the project id and sets the inherit
+// flag on the directory. Every file or directory created under a directory with
+// the +P flag inherits its project id, and new sub directories inherit the +P
+// flag too, so the whole tree is accounted without walking it. Files which
+// already exist in the directory keep their old project id, that is why the id
+// should be set before unpacking, otherwise SetFileAttrRecursive is needed.
+func PrepareQuotaDir(dir string, id uint32) error {
+	if id == 0 {
+		return errors.Errorf("invalid quota id(0) for dir(%s)", dir)
+	}
+
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to stat dir(%s)", dir)
+	}
+	if !fi.IsDir() {
+		return errors.Errorf("file(%s) is not a directory", dir)
+	}
+
+	// the dir prepared before keeps its quota id and inherit flag.
+	if GQuotaDriver.GetQuotaIDInFileAttr(dir) == id {
+		return nil
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read dir(%s)", dir)
+	}
+	if len(entries) > 0 {
+		log.WithFields(nil, map[string]interface{}{"dir": dir, "quotaID": id}).
+			Warnf("dir is not empty, existed files will not inherit quota id")
+	}
+
+	return GQuotaDriver.SetQuotaIDInFileAttr(dir, id)
+}
+
 // CheckRegularFile is used to check the file is regular file or directory.
 func CheckRegularFile(file string) (bool, error) {
 	fd, err := os.Lstat(file)
 	if err != nil {
-		log.With(nil).Warnf("failed to check file: %s, err: %v", file, err)
+		log.WithFields(nil, map[string]interface{}{"dir": file}).Warnf("failed to check file, err: %v", err)
 		return false, err
 	}
 
@@ -194,41 +709,24 @@ func IsSetQuotaID(id string) bool {
 // getOverlayMountInfo gets overlayFS informantion from /proc/mounts.
 // upperdir, mergeddir and workdir would be dealt.
 func getOverlayMountInfo(basefs string) (*OverlayMount, error) {
-	output, err := ioutil.ReadFile(procMountFile)
+	mounts, err := readMounts()
 	if err != nil {
-		log.With(nil).Warnf("failed to read file(%s), err(%v)", procMountFile, err)
+		log.WithFields(nil, map[string]interface{}{"dir": basefs}).
+			Warnf("failed to read file(%s), err(%v)", procMountFile, err)
 		return nil, err
 	}
 
 	var lowerDir, upperDir, workDir string
-	for _, line := range strings.Split(string(output), "\n") {
-		parts := strings.Split(string(line), " ")
-		if len(parts) != 6 {
-			continue
-		}
-		if parts[1] != basefs || parts[2] != "overlay" {
+	for _, m := range mounts {
+		if m.mountPoint != basefs || m.fsType != "overlay" {
 			continue
 		}
 		// the expected format is like following:
 		// overlay /var/lib/pouch/containerd/state/io.containerd.runtime.v1.linux/default/8d849ee68c8698531a2575f890be027dbd4dcb64f39cce37d7d22a703cbb362b/rootfs overlay rw,relatime,lowerdir=/var/lib/pouch/containerd/root/io.containerd.snapshotter.v1.overlayfs/snapshots/1/fs,upperdir=/var/lib/pouch/containerd/root/io.containerd.snapshotter.v1.overlayfs/snapshots/274/fs,workdir=/var/lib/pouch/containerd/root/io.containerd.snapshotter.v1.overlayfs/snapshots/274/work 0 0
-		// In part[3], it stored lowerdir, upperdir and workdir.
-		mountParams := strings.Split(parts[3], ",")
-		for _, p := range mountParams {
-			switch {
-			case strings.Contains(p, "lowerdir"):
-				if s := strings.Split(p, "="); len(s) == 2 {
-					lowerDir = s[1]
-				}
-			case strings.Contains(p, "upperdir"):
-				if s := strings.Split(p, "="); len(s) == 2 {
-					upperDir = s[1]
-				}
-			case strings.Contains(p, "workdir"):
-				if s := strings.Split(p, "="); len(s) == 2 {
-					workDir = s[1]
-				}
-			}
-		}
+		// the mount options stored lowerdir, upperdir and workdir.
+		lowerDir, _ = m.option("lowerdir")
+		upperDir, _ = m.option("upperdir")
+		workDir, _ = m.option("workdir")
 	}
 
 	if lowerDir == "" || upperDir == "" || workDir == "" {
@@ -242,6 +740,168 @@ func getOverlayMountInfo(basefs string) (*OverlayMount, error) {
 	}, nil
 }
 
+// checkQuotaDir returns ErrQuotaDirDenied if the directory resolves to the root of host
+// root filesystem or one of the denied directories, which protects the host from a
+// misconfigured path, such as the container rootfs resolving to "/". The directories are
+// compared by device and inode, so the symlink and bind mount of them are denied too.
+func checkQuotaDir(dir string, denyDirs []string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to stat dir(%s)", dir)
+	}
+
+	if root, err := os.Stat(hostRootDir); err == nil && os.SameFile(fi, root) {
+		return errors.Wrapf(ErrQuotaDirDenied, "dir(%s) resolves to the host root filesystem", dir)
+	}
+	for _, deny := range denyDirs {
+		if denied, err := os.Stat(deny); err == nil && os.SameFile(fi, denied) {
+			return errors.Wrapf(ErrQuotaDirDenied, "dir(%s) resolves to the denied dir(%s)", dir, deny)
+		}
+	}
+	return nil
+}
+
+// checkOverlayMount returns ErrOverlayNotSupported if the directory lies on overlay mountpoint,
+// the error tells the upper and work dirs of the mount, which quota should be enforced on instead.
+func checkOverlayMount(dir, mountPoint, fsType string) error {
+	if fsType != "overlay" {
+		return nil
+	}
+
+	if overlay, err := getOverlayMountInfo(mountPoint); err == nil {
+		return errors.Wrapf(ErrOverlayNotSupported, "dir (%s) lies on overlay mountpoint (%s), enforce quota on its upperdir (%s) and workdir (%s) instead",
+			dir, mountPoint, overlay.Upper, overlay.Work)
+	}
+	return errors.Wrapf(ErrOverlayNotSupported, "dir (%s) lies on overlay mountpoint (%s), enforce quota on its upperdir and workdir instead",
+		dir, mountPoint)
+}
+
+// getMountpointDevice returns the device which is mounted on the mountpoint,
+// it is the top one if the mountpoint is stacked.
+func getMountpointDevice(mountPoint string) (string, error) {
+	mounts, err := readMounts()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read file(%s)", procMountFile)
+	}
+
+	if m := findTopMount(mounts, mountPoint); m != nil {
+		return m.device, nil
+	}
+
+	return "", errors.Errorf("failed to find device of mountpoint(%s)", mountPoint)
+}
+
+// findDeviceMount returns the /proc/mounts entry of the device,
+// it returns nil if no entry is found.
+//
+// The entry is matched by the device id of its mountpoint, which is the id of the
+// partition, not the whole disk, for the partitioned device, so the supported layouts
+// are the whole disk, the partition, device mapper (LVM) and loop device, which are
+// mounted directly or bind mounted. If the device is mounted more than once, the
+// shortest mountpoint is returned.
+//
+// When the mountpoint is stacked, such as /dev/sdb2 is mounted over /dev/sdb1 on the
+// same path, all the entries of the path stat to the top device. So the entry whose
+// source is a block device node with another device number is skipped, otherwise
+// the hidden partition's filesystem type and options would be returned.
+//
+// /dev/sdb1 /home/pouch ext4 rw,relatime,prjquota,data=ordered 0 0
+func findDeviceMount(devID uint64) (*mountinfo, error) {
+	mounts, err := readMounts()
+	if err != nil {
+		return nil, err
+	}
+
+	var found *mountinfo
+	for _, m := range mounts {
+		devID2, _ := mountDevID(m.mountPoint)
+		if devID != devID2 {
+			continue
+		}
+
+		// btrfs uses anonymous device id, which is not the device number of its device node.
+		if m.fsType != "btrfs" {
+			if rdev, err := deviceRdev(m.device); err == nil && rdev != devID {
+				continue
+			}
+		}
+
+		// check the shortest mountpoint, the later one is on top if the mountpoint is the same.
+		if found != nil && len(found.mountPoint) < len(m.mountPoint) {
+			continue
+		}
+		found = m
+	}
+
+	return found, nil
+}
+
+// getDeviceRdev returns the device number of the block device node.
+func getDeviceRdev(device string) (uint64, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(device, &st); err != nil {
+		return 0, err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return 0, errors.Errorf("%s is not a block device", device)
+	}
+	return uint64(st.Rdev), nil
+}
+
+// getDeviceMountpoint returns the first mountpoint on which the device is mounted.
+func getDeviceMountpoint(device string) (string, error) {
+	mounts, err := readMounts()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read file(%s)", procMountFile)
+	}
+
+	for _, m := range mounts {
+		if m.device == device {
+			return m.mountPoint, nil
+		}
+	}
+
+	return "", errors.Errorf("failed to find mountpoint of device(%s)", device)
+}
+
+// parseQuotaLimits parses the quota ids which have block hard limit for each device
+// from `repquota -Pan` or `repquota -gan` output, only the ids allocated by pouch are returned.
+//
+// *** Report for project quotas on device /dev/sdb1
+// Block grace time: 7days; Inode grace time: 7days
+// Project         used    soft    hard  grace    used  soft  hard  grace
+// ----------------------------------------------------------------------
+// #0        --     220       0       0             25     0     0
+// #16777220 +- 2048576       0 2048575              9     0     0
+func parseQuotaLimits(output string) map[string][]uint32 {
+	limits := make(map[string][]uint32)
+
+	device := ""
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "***") {
+			if i := strings.LastIndex(line, " on device "); i >= 0 {
+				device = strings.TrimSpace(line[i+len(" on device "):])
+			}
+			continue
+		}
+
+		parts := strings.Fields(line)
+		if device == "" || len(parts) < 5 || !strings.HasPrefix(parts[0], "#") {
+			continue
+		}
+		id, err := strconv.ParseUint(parts[0][1:], 10, 32)
+		if err != nil || uint32(id) <= QuotaMinID {
+			continue
+		}
+		if parts[4] == "0" {
+			continue
+		}
+		limits[device] = append(limits[device], uint32(id))
+	}
+
+	return limits
+}
+
 // loadQuotaIDs loads quota IDs for quota driver from reqquota execution result.
 // This function utils `repquota` which summarizes quotas for a filesystem.
 // see http://man7.org/linux/man-pages/man8/repquota.8.html
@@ -265,11 +925,11 @@ func getOverlayMountInfo(basefs string) (*OverlayMount, error) {
 // #16777220 +- 2048576       0 2048575              9     0     0
 // #500      --   47504       0       0            101     0     0
 // #16777221 -- 3048576       0 3048576              8     0     0
-func loadQuotaIDs(repquotaOpt string) (map[uint32]struct{}, uint32, error) {
+func loadQuotaIDs(repquota, repquotaOpt string) (map[uint32]struct{}, uint32, error) {
 	quotaIDs := make(map[uint32]struct{})
 
 	minID := QuotaMinID
-	exit, output, stderr, err := exec.Run(0, "repquota", repquotaOpt)
+	exit, output, stderr, err := execRun(0, repquota, repquotaOpt)
 	if err != nil {
 		return nil, 0, errors.Wrapf(err, "failed to execute [repquota %s], stdout: (%s), stderr: (%s), exit: (%d)",
 			repquotaOpt, output, stderr, exit)
@@ -296,35 +956,195 @@ func loadQuotaIDs(repquotaOpt string) (map[uint32]struct{}, uint32, error) {
 			}
 		}
 	}
-	log.With(nil).Infof("Load repquota ids(%d), list(%v)", len(quotaIDs), quotaIDs)
+	log.WithFields(nil, map[string]interface{}{"repquota": repquota, "option": repquotaOpt}).
+		Infof("Load repquota ids(%d), list(%v)", len(quotaIDs), quotaIDs)
 	return quotaIDs, minID, nil
 }
 
-// getDevLimit returns the device storage upper limit.
-func getDevLimit(info *MountInfo) (uint64, error) {
+// getQuotaUsage gets the disk usage and limit of quota id on the mountpoint by repquota,
+// repquotaOpt is -P for project quota and -g for group quota.
+func getQuotaUsage(repquota, repquotaOpt string, quotaID uint32, mountPoint string) (*QuotaUsage, error) {
+	exit, stdout, stderr, err := execRun(0, repquota, repquotaOpt, "-n", mountPoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to execute [repquota %s -n %s], stdout: (%s), stderr: (%s), exit: (%d)",
+			repquotaOpt, mountPoint, stdout, stderr, exit)
+	}
+	return parseQuotaUsage(stdout, quotaID)
+}
+
+// parseQuotaUsage parses the block usage, soft and hard limits of quota id from repquota output,
+// the values in output are in kbytes.
+//
+// #16777220 +- 2048576       0 2048575              9     0     0
+func parseQuotaUsage(output string, quotaID uint32) (*QuotaUsage, error) {
+	prefix := fmt.Sprintf("#%d", quotaID)
+	for _, line := range strings.Split(output, "\n") {
+		parts := strings.Fields(line)
+		if len(parts) < 5 || parts[0] != prefix {
+			continue
+		}
+
+		used, err := strconv.ParseUint(parts[2], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse used blocks of quota id(%d)", quotaID)
+		}
+		softLimit, err := strconv.ParseUint(parts[3], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse soft limit of quota id(%d)", quotaID)
+		}
+		limit, err := strconv.ParseUint(parts[4], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse hard limit of quota id(%d)", quotaID)
+		}
+		return &QuotaUsage{
+			QuotaID:   quotaID,
+			Used:      used * 1024,
+			Limit:     limit * 1024,
+			SoftLimit: softLimit * 1024,
+		}, nil
+	}
+
+	return nil, errors.Errorf("quota id(%d) not found in repquota output", quotaID)
+}
+
+// parseQuotaUsages parses the block usage, soft and hard limits of all quota ids from repquota
+// output, the values in output are in kbytes. A malformed line does not discard the others,
+// the parsed entries are returned together with an error listing the malformed lines.
+//
+// #0        --     220       0       0             25     0     0
+// #16777220 +- 2048576 1048576 2048575  6days      9     0     0
+func parseQuotaUsages(output string) (map[uint32]*QuotaUsage, error) {
+	usages := make(map[uint32]*QuotaUsage)
+
+	var malformed []string
+	for _, line := range strings.Split(output, "\n") {
+		parts := strings.Fields(line)
+		if len(parts) == 0 || !strings.HasPrefix(parts[0], "#") {
+			continue
+		}
+
+		var values [3]uint64
+		id, err := strconv.ParseUint(parts[0][1:], 10, 32)
+		if err == nil && len(parts) < 5 {
+			err = errors.Errorf("too few fields")
+		}
+		for i := 0; err == nil && i < len(values); i++ {
+			values[i], err = strconv.ParseUint(parts[i+2], 10, 64)
+		}
+		if err != nil {
+			malformed = append(malformed, fmt.Sprintf("(%s): %v", line, err))
+			continue
+		}
+
+		usages[uint32(id)] = &QuotaUsage{
+			QuotaID:   uint32(id),
+			Used:      values[0] * 1024,
+			SoftLimit: values[1] * 1024,
+			Limit:     values[2] * 1024,
+		}
+	}
+
+	if len(malformed) > 0 {
+		return usages, errors.Errorf("failed to parse repquota lines: %s", strings.Join(malformed, ", "))
+	}
+	return usages, nil
+}
+
+// parseLimitedQuotaIDs parses the quota ids which have block limit from
+// `repquota -P -n $mountpoint` output, the default id 0 is excluded.
+//
+// #0        --     220       0       0             25     0     0
+// #16777220 +- 2048576 1048576 2048575  6days      9     0     0
+func parseLimitedQuotaIDs(output string) []uint32 {
+	var ids []uint32
+	for _, line := range strings.Split(output, "\n") {
+		parts := strings.Fields(line)
+		if len(parts) < 5 || !strings.HasPrefix(parts[0], "#") {
+			continue
+		}
+		id, err := strconv.ParseUint(parts[0][1:], 10, 32)
+		if err != nil || id == 0 {
+			continue
+		}
+		if parts[3] == "0" && parts[4] == "0" {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+	return ids
+}
+
+// parseTotalLimit sums the block hard limits of all quota ids in `repquota -P -n $mountpoint`
+// output, the default id 0 is excluded. The returned total is in bytes.
+//
+// #0        --     220       0       0             25     0     0
+// #16777220 +- 2048576 1048576 2048575  6days      9     0     0
+func parseTotalLimit(output string) (uint64, error) {
+	var total uint64
+	for _, line := range strings.Split(output, "\n") {
+		parts := strings.Fields(line)
+		if len(parts) < 5 || !strings.HasPrefix(parts[0], "#") {
+			continue
+		}
+		id, err := strconv.ParseUint(parts[0][1:], 10, 32)
+		if err != nil || id == 0 {
+			continue
+		}
+		limit, err := strconv.ParseUint(parts[4], 10, 64)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to parse hard limit of quota id(%d)", id)
+		}
+		total += limit * 1024
+	}
+	return total, nil
+}
+
+// getDevStatfs returns the filesystem statistics of the device.
+func getDevStatfs(info *MountInfo) (*syscall.Statfs_t, error) {
 	mp := info.MountPoint
 	devID := info.DeviceID
 
 	newDevID, _ := system.GetDevID(mp)
 	if newDevID != devID {
-		return 0, errors.Errorf("failed to set device limit, no such device id(%d), checked id(%d)",
-			devID, newDevID)
+		return nil, errors.Errorf("failed to statfs path(%s), no such device id(%d), checked id(%d)",
+			mp, devID, newDevID)
 	}
 
-	// get storage upper limit of the device which the dir is on.
 	var stfs syscall.Statfs_t
-	if err := syscall.Statfs(mp, &stfs); err != nil {
-		log.With(nil).Errorf("failed to get path(%s) limit, err(%v)", mp, err)
-		return 0, errors.Wrapf(err, "failed to get path(%s) limit", mp)
+	if err := statfs(mp, &stfs); err != nil {
+		log.WithFields(nil, map[string]interface{}{"devID": devID, "mountpoint": mp}).Errorf("failed to statfs path, err(%v)", err)
+		return nil, errors.Wrapf(err, "failed to statfs path(%s)", mp)
 	}
-	limit := stfs.Blocks * uint64(stfs.Bsize)
+	return &stfs, nil
+}
 
-	log.With(nil).Debugf("get device limit size, mountpoint(%s), limit(%v) B", mp, limit)
+// getDevLimit returns the device storage upper limit.
+func getDevLimit(info *MountInfo) (uint64, error) {
+	// get storage upper limit of the device which the dir is on.
+	stfs, err := getDevStatfs(info)
+	if err != nil {
+		return 0, err
+	}
+	limit := stfs.Blocks * devBlockSize(stfs)
+
+	log.WithFields(nil, map[string]interface{}{"devID": info.DeviceID, "mountpoint": info.MountPoint}).
+		Debugf("get device limit size, limit(%v) B", limit)
 	return limit, nil
 }
 
+// devBlockSize returns the block size in which the blocks of filesystem are counted.
+// f_blocks is counted in fragment size f_frsize, which is the same as f_bsize on
+// ext4 and xfs generally, and f_bsize is used if f_frsize is not reported.
+func devBlockSize(stfs *syscall.Statfs_t) uint64 {
+	if stfs.Frsize > 0 {
+		return uint64(stfs.Frsize)
+	}
+	return uint64(stfs.Bsize)
+}
+
 // checkDevLimit checks if the device on which the input dir lies has already been recorded in driver.
-func checkDevLimit(mountInfo *MountInfo, size uint64) error {
+// The inode number is checked against the device as well, 0 means no inode limit.
+func checkDevLimit(mountInfo *MountInfo, size, inodes uint64) error {
 	mp := mountInfo.MountPoint
 
 	limit, err := getDevLimit(mountInfo)
@@ -336,7 +1156,31 @@ func checkDevLimit(mountInfo *MountInfo, size uint64) error {
 		return fmt.Errorf("dir %s quota limit %v must be less than %v", mp, size, limit)
 	}
 
-	log.With(nil).Debugf("succeeded in checkDevLimit (dir %s quota limit %v B) with size %v B", mp, limit, size)
+	log.WithFields(nil, map[string]interface{}{"devID": mountInfo.DeviceID, "fstype": mountInfo.FsType, "mountpoint": mp}).
+		Debugf("succeeded in checkDevLimit (quota limit %v B) with size %v B", limit, size)
+
+	if inodes > 0 {
+		return checkDevInodeLimit(mountInfo, inodes)
+	}
+	return nil
+}
+
+// checkDevInodeLimit checks the requested inode number is not more than
+// the total inode number of the device on which the input dir lies.
+func checkDevInodeLimit(mountInfo *MountInfo, inodes uint64) error {
+	mp := mountInfo.MountPoint
+
+	stfs, err := getDevStatfs(mountInfo)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get device(%s) inode limit", mp)
+	}
+
+	if stfs.Files < inodes {
+		return fmt.Errorf("dir %s inode quota limit %v must be less than %v", mp, inodes, stfs.Files)
+	}
+
+	log.WithFields(nil, map[string]interface{}{"devID": mountInfo.DeviceID, "fstype": mountInfo.FsType, "mountpoint": mp}).
+		Debugf("succeeded in checkDevInodeLimit (inode limit %v) with inodes %v", stfs.Files, inodes)
 
 	return nil
 }
@@ -3,10 +3,21 @@
 package quota
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/alibaba/pouch/pkg/system"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 func Test_getDevID(t *testing.T) {
@@ -28,3 +39,914 @@ func Test_getDevID(t *testing.T) {
 		t.Fatalf("getDevID error expect %d got %d", expectID, gotID)
 	}
 }
+
+// fakeRunner simulates the quota tools, and records the executed commands.
+type fakeRunner struct {
+	lock     sync.Mutex
+	commands [][]string
+
+	// attrs saves the quota id set by chattr, key is the directory.
+	attrs map[string]string
+
+	// results saves the results returned in order for the command, key is the command.
+	results map[string][]fakeResult
+}
+
+// fakeResult represents the result of a command.
+type fakeResult struct {
+	exit   int
+	stdout string
+	stderr string
+	err    error
+}
+
+// newFakeRunner replaces execRun by a fakeRunner, the returned function restores it.
+func newFakeRunner() (*fakeRunner, func()) {
+	r := &fakeRunner{
+		attrs:   make(map[string]string),
+		results: make(map[string][]fakeResult),
+	}
+	origin, originGetProjectID := execRun, getProjectID
+	execRun = r.run
+	// the quota id is read from the fake attrs by lsattr.
+	getProjectID = func(string) (uint32, error) {
+		return 0, syscall.ENOTTY
+	}
+	return r, func() {
+		execRun, getProjectID = origin, originGetProjectID
+	}
+}
+
+func (r *fakeRunner) run(timeout time.Duration, bin string, args ...string) (int, string, string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.commands = append(r.commands, append([]string{bin}, args...))
+
+	if results := r.results[bin]; len(results) > 0 {
+		r.results[bin] = results[1:]
+		return results[0].exit, results[0].stdout, results[0].stderr, results[0].err
+	}
+
+	switch bin {
+	case "chattr":
+		// chattr [-R] -p $ID +P $DIR
+		r.attrs[args[len(args)-1]] = args[len(args)-3]
+	case "lsattr":
+		// lsattr -p $PARENT
+		var lines []string
+		for dir, id := range r.attrs {
+			if path.Dir(dir) == args[len(args)-1] {
+				lines = append(lines, fmt.Sprintf("%s --------------e---P %s", id, dir))
+			}
+		}
+		return 0, strings.Join(lines, "\n"), "", nil
+	case "tune2fs":
+		return 0, "Filesystem features:      has_journal extent project quota\n", "", nil
+	}
+	return 0, "", "", nil
+}
+
+// executed returns the commands which are executed by bin.
+func (r *fakeRunner) executed(bin string) [][]string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var cmds [][]string
+	for _, cmd := range r.commands {
+		if cmd[0] == bin {
+			cmds = append(cmds, cmd)
+		}
+	}
+	return cmds
+}
+
+// newTestDir creates a directory for test, skip the test if no mountpoint is found for it.
+func newTestDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "quota-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+
+	devID, err := getDevID(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("failed to get dev id of %s: %v", dir, err)
+	}
+	if mp, _, _ := (&PrjQuotaDriver{}).CheckMountpoint(devID); mp == "" {
+		os.RemoveAll(dir)
+		t.Skipf("no mountpoint found for %s", dir)
+	}
+
+	return dir, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestPrjQuotaSetDiskQuotaWithResult(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+
+	driver := &PrjQuotaDriver{
+		quotaIDs: make(map[uint32]struct{}),
+		lastID:   QuotaMinID,
+	}
+
+	result, err := driver.SetDiskQuotaWithResult(dir, "1m", 0)
+	if err != nil {
+		t.Fatalf("failed to set disk quota: %v", err)
+	}
+	if result.QuotaID != QuotaMinID+1 {
+		t.Fatalf("expect quota id %d, got %d", QuotaMinID+1, result.QuotaID)
+	}
+	if got := driver.GetQuotaIDInFileAttr(dir); got != result.QuotaID {
+		t.Fatalf("expect quota id in file attr %d, got %d", result.QuotaID, got)
+	}
+	if result.MountPoint == "" {
+		t.Fatalf("expect mountpoint to be returned")
+	}
+
+	devID, err := getDevID(dir)
+	if err != nil {
+		t.Fatalf("failed to get dev id of %s: %v", dir, err)
+	}
+	if _, _, fsType := driver.CheckMountpoint(devID); result.FsType != fsType {
+		t.Fatalf("expect filesystem type %s, got %s", fsType, result.FsType)
+	}
+
+	setquota := runner.executed("setquota")
+	if len(setquota) != 1 || setquota[0][len(setquota[0])-1] != result.MountPoint {
+		t.Fatalf("expect setquota on mountpoint %s, got %v", result.MountPoint, setquota)
+	}
+}
+
+// fieldsHook records the fields of every log entry fired.
+type fieldsHook struct {
+	lock    sync.Mutex
+	entries []logrus.Fields
+}
+
+func (h *fieldsHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *fieldsHook) Fire(entry *logrus.Entry) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.entries = append(h.entries, entry.Data)
+	return nil
+}
+
+func TestPrjQuotaLogFields(t *testing.T) {
+	_, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+
+	hook := &fieldsHook{}
+	logger := logrus.StandardLogger()
+	level, hooks, out := logrus.GetLevel(), logger.Hooks, logger.Out
+	logger.Hooks = make(logrus.LevelHooks)
+	logger.Out = ioutil.Discard
+	logrus.SetLevel(logrus.DebugLevel)
+	logrus.AddHook(hook)
+	defer func() {
+		logrus.SetLevel(level)
+		logger.Hooks, logger.Out = hooks, out
+	}()
+
+	driver := &PrjQuotaDriver{
+		quotaIDs: make(map[uint32]struct{}),
+		lastID:   QuotaMinID,
+	}
+	result, err := driver.SetDiskQuotaWithResult(dir, "1m", 0)
+	if err != nil {
+		t.Fatalf("failed to set disk quota: %v", err)
+	}
+
+	var withDir, withQuotaID, withMountpoint bool
+	for _, fields := range hook.entries {
+		if fields["dir"] == dir {
+			withDir = true
+		}
+		if fields["quotaID"] == result.QuotaID {
+			withQuotaID = true
+		}
+		if fields["mountpoint"] == result.MountPoint {
+			withMountpoint = true
+		}
+	}
+	if !withDir || !withQuotaID || !withMountpoint {
+		t.Fatalf("expect dir, quotaID and mountpoint fields in logs, got %v", hook.entries)
+	}
+}
+
+func TestSetLogDirQuotaSameDevice(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	rootfs, clean := newTestDir(t)
+	defer clean()
+
+	logDir := path.Join(rootfs, "log")
+	if err := os.Mkdir(logDir, 0755); err != nil {
+		t.Fatalf("failed to create log dir: %v", err)
+	}
+
+	origin := GQuotaDriver
+	defer func() { GQuotaDriver = origin }()
+	GQuotaDriver = &PrjQuotaDriver{
+		quotaIDs: make(map[uint32]struct{}),
+		lastID:   QuotaMinID,
+	}
+
+	result, err := SetDiskQuotaWithResult(rootfs, "10m", 0)
+	if err != nil {
+		t.Fatalf("failed to set rootfs disk quota: %v", err)
+	}
+
+	// log dir inherits the rootfs quota id from its parent.
+	runner.attrs[logDir] = fmt.Sprint(result.QuotaID)
+
+	id, err := SetLogDirQuota(logDir, "1m", result.QuotaID)
+	if err != nil {
+		t.Fatalf("failed to set log dir disk quota: %v", err)
+	}
+	if id == 0 || id == result.QuotaID {
+		t.Fatalf("expect log dir quota id distinct from rootfs %d, got %d", result.QuotaID, id)
+	}
+	if got := GetQuotaIDInFileAttr(logDir); got != id {
+		t.Fatalf("expect quota id in log dir file attr %d, got %d", id, got)
+	}
+
+	setquota := runner.executed("setquota")
+	if len(setquota) != 2 || setquota[1][2] != fmt.Sprint(id) {
+		t.Fatalf("expect setquota on log dir quota id %d, got %v", id, setquota)
+	}
+}
+
+func TestSetLogDirQuotaSeparateDevice(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	rootfs, clean := newTestDir(t)
+	defer clean()
+
+	logDir, err := ioutil.TempDir("/dev/shm", "quota-test-log")
+	if err != nil {
+		t.Skipf("failed to create log dir on /dev/shm: %v", err)
+	}
+	defer os.RemoveAll(logDir)
+
+	origin := GQuotaDriver
+	defer func() { GQuotaDriver = origin }()
+	GQuotaDriver = &PrjQuotaDriver{
+		quotaIDs: make(map[uint32]struct{}),
+		lastID:   QuotaMinID,
+	}
+	if getMountpointFstype(logDir) != "tmpfs" {
+		t.Skipf("/dev/shm is not tmpfs")
+	}
+
+	result, err := SetDiskQuotaWithResult(rootfs, "10m", 0)
+	if err != nil {
+		t.Fatalf("failed to set rootfs disk quota: %v", err)
+	}
+
+	// /dev/shm is shared with host, it is never remounted with the size of log dir.
+	if _, err := SetLogDirQuota(logDir, "1m", result.QuotaID); err == nil {
+		t.Fatalf("expect error of log dir on shared tmpfs")
+	}
+	for _, mount := range runner.executed("mount") {
+		if reflect.DeepEqual(mount[len(mount)-1:], []string{"/dev/shm"}) {
+			t.Fatalf("expect /dev/shm not to be remounted, got %v", mount)
+		}
+	}
+	if setquota := runner.executed("setquota"); len(setquota) != 1 {
+		t.Fatalf("expect setquota only on rootfs, got %v", setquota)
+	}
+}
+
+func TestSetVolumeQuota(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	parent, clean := newTestDir(t)
+	defer clean()
+
+	volume := path.Join(parent, "volume")
+	if err := os.Mkdir(volume, 0755); err != nil {
+		t.Fatalf("failed to create volume dir: %v", err)
+	}
+
+	origin := GQuotaDriver
+	defer func() { GQuotaDriver = origin }()
+	driver := &PrjQuotaDriver{
+		quotaIDs: make(map[uint32]struct{}),
+		lastID:   QuotaMinID,
+		// the inherited quota id is not a conflict.
+		rejectConflict: true,
+	}
+	GQuotaDriver = driver
+
+	// volume dir inherits the quota id from its parent.
+	parentID := QuotaMinID + 100
+	runner.attrs[parent] = fmt.Sprint(parentID)
+	runner.attrs[volume] = fmt.Sprint(parentID)
+
+	id, err := SetVolumeQuota(volume, "10m")
+	if err != nil {
+		t.Fatalf("failed to set volume disk quota: %v", err)
+	}
+	if id == 0 || id == parentID {
+		t.Fatalf("expect volume quota id distinct from parent %d, got %d", parentID, id)
+	}
+	if got := GetQuotaIDInFileAttr(volume); got != id {
+		t.Fatalf("expect quota id in volume file attr %d, got %d", id, got)
+	}
+
+	// the volume shared by another container reuses its own quota id.
+	id2, err := SetVolumeQuota(volume, "10m")
+	if err != nil {
+		t.Fatalf("failed to set volume disk quota again: %v", err)
+	}
+	if id2 != id {
+		t.Fatalf("expect shared volume to reuse quota id %d, got %d", id, id2)
+	}
+
+	var recursive int
+	for _, cmd := range runner.executed("chattr") {
+		if cmd[1] == "-R" {
+			recursive++
+		}
+	}
+	if recursive != 1 {
+		t.Fatalf("expect volume quota id set recursively once, got %d", recursive)
+	}
+	setquota := runner.executed("setquota")
+	if len(setquota) != 1 || setquota[0][2] != fmt.Sprint(id) {
+		t.Fatalf("expect setquota on volume quota id %d once, got %v", id, setquota)
+	}
+
+	// the quota of volume is cleared and its quota id is released on removal.
+	if err := ReleaseVolumeQuota(volume); err != nil {
+		t.Fatalf("failed to release volume quota: %v", err)
+	}
+	setquota = runner.executed("setquota")
+	if len(setquota) != 2 || strings.Join(setquota[1][2:6], " ") != fmt.Sprintf("%d 0 0 0", id) {
+		t.Fatalf("expect quota of volume quota id %d cleared, got %v", id, setquota)
+	}
+	if _, ok := driver.quotaIDs[id]; ok {
+		t.Fatalf("expect volume quota id %d released", id)
+	}
+}
+
+func TestGetDiskQuotaReport(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+	if getMountpointFstype(dir) == "tmpfs" {
+		t.Skipf("%s lies on tmpfs", dir)
+	}
+
+	origin, originStatfs := GQuotaDriver, statfs
+	defer func() {
+		GQuotaDriver, statfs = origin, originStatfs
+	}()
+	GQuotaDriver = &PrjQuotaDriver{
+		quotaIDs: make(map[uint32]struct{}),
+		lastID:   QuotaMinID,
+	}
+	statfs = func(path string, buf *syscall.Statfs_t) error {
+		buf.Bsize = 4096
+		buf.Blocks = 1000
+		buf.Bfree = 100
+		buf.Bavail = 50
+		return nil
+	}
+
+	id := QuotaMinID + 1
+	runner.attrs[dir] = fmt.Sprint(id)
+	runner.results["repquota"] = []fakeResult{{stdout: fmt.Sprintf("#%d -- 1024 0 2048 3 0 0\n", id)}}
+
+	report, err := GetDiskQuotaReport(dir)
+	if err != nil {
+		t.Fatalf("failed to get disk quota report: %v", err)
+	}
+	expect := &DiskQuotaReport{
+		Quota:   &QuotaUsage{QuotaID: id, Used: 1024 * 1024, Limit: 2048 * 1024},
+		FsSize:  1000 * 4096,
+		FsFree:  100 * 4096,
+		FsAvail: 50 * 4096,
+	}
+	if !reflect.DeepEqual(report, expect) {
+		t.Fatalf("expect report %+v with quota %+v, got %+v with quota %+v", expect, expect.Quota, report, report.Quota)
+	}
+}
+
+func Test_checkDevInodeLimit(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("get work directory error %v", err)
+	}
+	devID, err := system.GetDevID(wd)
+	if err != nil {
+		t.Fatalf("get dev id error of %s: %v", wd, err)
+	}
+
+	origin := statfs
+	defer func() {
+		statfs = origin
+	}()
+	statfs = func(path string, buf *syscall.Statfs_t) error {
+		buf.Files = 1000
+		buf.Blocks = 1024
+		buf.Bsize = 4096
+		return nil
+	}
+
+	mountInfo := &MountInfo{
+		MountPoint: wd,
+		DeviceID:   devID,
+	}
+	if err := checkDevInodeLimit(mountInfo, 1000); err != nil {
+		t.Fatalf("expect inode limit 1000 to be valid, got %v", err)
+	}
+	if err := checkDevInodeLimit(mountInfo, 1001); err == nil {
+		t.Fatalf("expect inode limit 1001 to be invalid")
+	}
+
+	// the inode number is checked along with the size.
+	if err := checkDevLimit(mountInfo, 1024*1024, 1000); err != nil {
+		t.Fatalf("expect size 1m with inode limit 1000 to be valid, got %v", err)
+	}
+	if err := checkDevLimit(mountInfo, 1024*1024, 1001); err == nil {
+		t.Fatalf("expect size 1m with inode limit 1001 to be invalid")
+	}
+}
+
+func Test_checkDevLimitBlockSize(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("get work directory error %v", err)
+	}
+	devID, err := system.GetDevID(wd)
+	if err != nil {
+		t.Fatalf("get dev id error of %s: %v", wd, err)
+	}
+
+	origin := statfs
+	defer func() {
+		statfs = origin
+	}()
+
+	mountInfo := &MountInfo{
+		MountPoint: wd,
+		DeviceID:   devID,
+	}
+	size := uint64(2 * 1024 * 1024)
+
+	for _, tc := range []struct {
+		blockSize int64
+		valid     bool
+	}{
+		// 1024 blocks of 1k is 1m, less than the size.
+		{blockSize: 1024, valid: false},
+		// 1024 blocks of 4k is 4m, more than the size.
+		{blockSize: 4096, valid: true},
+	} {
+		statfs = func(path string, buf *syscall.Statfs_t) error {
+			buf.Blocks = 1024
+			buf.Bsize = tc.blockSize
+			buf.Frsize = tc.blockSize
+			return nil
+		}
+
+		err := checkDevLimit(mountInfo, size, 0)
+		if tc.valid != (err == nil) {
+			t.Fatalf("block size %d: expect valid %v, got %v", tc.blockSize, tc.valid, err)
+		}
+	}
+}
+
+func Test_parseQuotaUsage(t *testing.T) {
+	output := `Project         used    soft    hard  grace    used  soft  hard  grace
+----------------------------------------------------------------------
+#0        --     220       0       0             25     0     0
+#16777220 +- 2048576       0 2048575              9     0     0
+#16777222 --    1024    2048    4096              3     0     0
+`
+	usage, err := parseQuotaUsage(output, 16777220)
+	if err != nil {
+		t.Fatalf("failed to parse quota usage: %v", err)
+	}
+	if usage.Used != 2048576*1024 || usage.Limit != 2048575*1024 || usage.SoftLimit != 0 {
+		t.Fatalf("expect used %d and limit %d, got %v", 2048576*1024, 2048575*1024, usage)
+	}
+
+	usage, err = parseQuotaUsage(output, 16777222)
+	if err != nil {
+		t.Fatalf("failed to parse quota usage: %v", err)
+	}
+	if usage.SoftLimit != 2048*1024 || usage.Limit != 4096*1024 {
+		t.Fatalf("expect soft limit %d and limit %d, got %v", 2048*1024, 4096*1024, usage)
+	}
+
+	if _, err := parseQuotaUsage(output, 16777221); err == nil {
+		t.Fatalf("expect error for quota id not found")
+	}
+}
+
+func Test_parseQuotaUsages(t *testing.T) {
+	output := `*** Report for project quotas on device /dev/sdb1
+Block grace time: 7days; Inode grace time: 7days
+Project         used    soft    hard  grace    used  soft  hard  grace
+----------------------------------------------------------------------
+#0        --     220       0       0             25     0     0
+#16777220 +- 2048576 1048576 2048575  6days      9     0     0
+#16777221 --    1024     abc   10240              3     0     0
+#16777222 --      16       0    4096              1     0     0
+`
+	usages, err := parseQuotaUsages(output)
+	if err == nil || !strings.Contains(err.Error(), "#16777221") {
+		t.Fatalf("expect error listing the malformed line, got %v", err)
+	}
+
+	expect := map[uint32]*QuotaUsage{
+		0:        {QuotaID: 0, Used: 220 * 1024},
+		16777220: {QuotaID: 16777220, Used: 2048576 * 1024, SoftLimit: 1048576 * 1024, Limit: 2048575 * 1024},
+		16777222: {QuotaID: 16777222, Used: 16 * 1024, Limit: 4096 * 1024},
+	}
+	if !reflect.DeepEqual(usages, expect) {
+		t.Fatalf("expect the valid entries %v, got %v", expect, usages)
+	}
+}
+
+func Test_parseTotalLimit(t *testing.T) {
+	output := `*** Report for project quotas on device /dev/sdb1
+Block grace time: 7days; Inode grace time: 7days
+Project         used    soft    hard  grace    used  soft  hard  grace
+----------------------------------------------------------------------
+#0        --     220       0  102400             25     0     0
+#16777220 +- 2048576 1048576 2048575  6days      9     0     0
+#16777221 --    1024       0   10240              3     0     0
+#16777222 --      16       0       0              1     0     0
+`
+	total, err := parseTotalLimit(output)
+	if err != nil {
+		t.Fatalf("failed to parse total limit: %v", err)
+	}
+	if expect := uint64(2048575+10240) * 1024; total != expect {
+		t.Fatalf("expect total limit %d, got %d", expect, total)
+	}
+
+	if _, err := parseTotalLimit("#16777220 -- 1024 0 abc 3 0 0"); err == nil {
+		t.Fatalf("expect error for malformed hard limit")
+	}
+}
+
+func TestPrjQuotaCheckMountpointPartitioned(t *testing.T) {
+	mounts := `/dev/sda1 / ext4 rw,relatime 0 0
+/dev/sdb1 /data ext4 rw,relatime,prjquota 0 0
+/dev/sdb2 /data/pouch ext4 rw,relatime 0 0
+/dev/sdb1 /mnt/data ext4 rw,relatime,prjquota 0 0
+/dev/sdc1 /stack xfs rw,relatime,prjquota 0 0
+/dev/sdc2 /stack ext4 rw,relatime 0 0
+/dev/sdd1 /vol btrfs rw,relatime 0 0
+`
+	f, err := ioutil.TempFile("", "quota-mounts")
+	if err != nil {
+		t.Fatalf("failed to create mounts fixture: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(mounts); err != nil {
+		t.Fatalf("failed to write mounts fixture: %v", err)
+	}
+	f.Close()
+
+	mountIDs := map[string]uint64{
+		"/":           0x801,
+		"/data":       0x811,
+		"/data/pouch": 0x812,
+		"/mnt/data":   0x811,
+		// sdc2 is mounted over sdc1.
+		"/stack": 0x822,
+		// btrfs uses anonymous device id.
+		"/vol": 0x2a,
+	}
+	rdevs := map[string]uint64{
+		"/dev/sda1": 0x801,
+		"/dev/sdb1": 0x811,
+		"/dev/sdb2": 0x812,
+		"/dev/sdc1": 0x821,
+		"/dev/sdc2": 0x822,
+		"/dev/sdd1": 0x831,
+	}
+
+	originFile, originDevID, originRdev := procMountFile, mountDevID, deviceRdev
+	defer func() {
+		procMountFile, mountDevID, deviceRdev = originFile, originDevID, originRdev
+	}()
+	procMountFile = f.Name()
+	mountDevID = func(mp string) (uint64, error) {
+		return mountIDs[mp], nil
+	}
+	deviceRdev = func(device string) (uint64, error) {
+		if rdev, ok := rdevs[device]; ok {
+			return rdev, nil
+		}
+		return 0, syscall.ENOENT
+	}
+
+	for _, tc := range []struct {
+		name        string
+		devID       uint64
+		mountPoint  string
+		enableQuota bool
+		fsType      string
+	}{
+		{name: "root partition", devID: 0x801, mountPoint: "/", fsType: "ext4"},
+		{name: "partition bind mounted", devID: 0x811, mountPoint: "/data", enableQuota: true, fsType: "ext4"},
+		{name: "partition nested", devID: 0x812, mountPoint: "/data/pouch", fsType: "ext4"},
+		{name: "partition on top of stack", devID: 0x822, mountPoint: "/stack", fsType: "ext4"},
+		{name: "partition hidden by stack", devID: 0x821},
+		{name: "btrfs", devID: 0x2a, mountPoint: "/vol", fsType: "btrfs"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mountPoint, enableQuota, fsType := (&PrjQuotaDriver{}).CheckMountpoint(tc.devID)
+			if mountPoint != tc.mountPoint || enableQuota != tc.enableQuota || fsType != tc.fsType {
+				t.Fatalf("expect (%s, %v, %s), got (%s, %v, %s)",
+					tc.mountPoint, tc.enableQuota, tc.fsType, mountPoint, enableQuota, fsType)
+			}
+		})
+	}
+}
+
+func TestEnforceQuotaOnOverlay(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	rootfs, clean := newTestDir(t)
+	defer clean()
+
+	devID, err := getDevID(rootfs)
+	if err != nil {
+		t.Fatalf("failed to get dev id of %s: %v", rootfs, err)
+	}
+
+	mounts := fmt.Sprintf(`/dev/sda1 / ext4 rw,relatime 0 0
+overlay %s overlay rw,relatime,lowerdir=/snapshots/1/fs,upperdir=/snapshots/2/fs,workdir=/snapshots/2/work 0 0
+`, rootfs)
+	f, err := ioutil.TempFile("", "quota-mounts")
+	if err != nil {
+		t.Fatalf("failed to create mounts fixture: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(mounts); err != nil {
+		t.Fatalf("failed to write mounts fixture: %v", err)
+	}
+	f.Close()
+
+	originFile, originDevID := procMountFile, mountDevID
+	defer func() {
+		procMountFile, mountDevID = originFile, originDevID
+	}()
+	procMountFile = f.Name()
+	mountDevID = func(mp string) (uint64, error) {
+		if mp == rootfs {
+			return devID, nil
+		}
+		return 0, nil
+	}
+
+	for _, driver := range []BaseQuota{
+		&PrjQuotaDriver{quotaIDs: make(map[uint32]struct{}), lastID: QuotaMinID},
+		&GrpQuotaDriver{quotaIDs: make(map[uint32]struct{}), lastID: QuotaMinID},
+	} {
+		_, err := driver.EnforceQuota(rootfs)
+		if errors.Cause(err) != ErrOverlayNotSupported {
+			t.Fatalf("expect ErrOverlayNotSupported for %T, got %v", driver, err)
+		}
+		if !strings.Contains(err.Error(), "/snapshots/2/fs") || !strings.Contains(err.Error(), "/snapshots/2/work") {
+			t.Fatalf("expect error to tell upperdir and workdir, got %v", err)
+		}
+	}
+
+	if cmds := runner.executed("mount"); len(cmds) != 0 {
+		t.Fatalf("expect overlay not to be remounted, got %v", cmds)
+	}
+}
+
+func TestVerifyRootfsQuota(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	parent, clean := newTestDir(t)
+	defer clean()
+	if getMountpointFstype(parent) == "tmpfs" {
+		t.Skipf("%s lies on tmpfs", parent)
+	}
+
+	upper, work := path.Join(parent, "fs"), path.Join(parent, "work")
+	for _, dir := range []string{upper, work} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("failed to create dir: %v", err)
+		}
+	}
+
+	// the file attr is changed behind the driver, so never cache it.
+	origin, originTTL := GQuotaDriver, quotaIDCacheTTL
+	defer func() {
+		GQuotaDriver, quotaIDCacheTTL = origin, originTTL
+	}()
+	quotaIDCacheTTL = 0
+	GQuotaDriver = &PrjQuotaDriver{
+		quotaIDs: make(map[uint32]struct{}),
+		lastID:   QuotaMinID,
+	}
+
+	// quota id kept since create time is not re-applied.
+	quotaID := QuotaMinID + 100
+	runner.attrs[upper] = fmt.Sprint(quotaID)
+	runner.attrs[work] = fmt.Sprint(quotaID)
+	id, err := VerifyRootfsQuota(upper, work, "10m", 0)
+	if err != nil {
+		t.Fatalf("failed to verify rootfs quota: %v", err)
+	}
+	if id != quotaID {
+		t.Fatalf("expect quota id %d, got %d", quotaID, id)
+	}
+	if cmds := runner.executed("chattr"); len(cmds) != 0 {
+		t.Fatalf("expect no chattr when quota id is kept, got %v", cmds)
+	}
+
+	// the work dir lost its quota id.
+	runner.attrs[work] = "0"
+	id, err = VerifyRootfsQuota(upper, work, "10m", quotaID)
+	if err != nil {
+		t.Fatalf("failed to verify rootfs quota: %v", err)
+	}
+	if id != quotaID {
+		t.Fatalf("expect quota id %d, got %d", quotaID, id)
+	}
+	if got := GetQuotaIDInFileAttr(work); got != quotaID {
+		t.Fatalf("expect quota id in work dir file attr %d, got %d", quotaID, got)
+	}
+	var recursive int
+	for _, cmd := range runner.executed("chattr") {
+		if cmd[len(cmd)-1] != work {
+			t.Fatalf("expect quota id re-applied on work dir only, got %v", cmd)
+		}
+		if cmd[1] == "-R" {
+			recursive++
+		}
+	}
+	if recursive != 1 {
+		t.Fatalf("expect quota id re-applied on work dir recursively once, got %d", recursive)
+	}
+}
+
+func TestReleaseRootfsQuota(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	parent, clean := newTestDir(t)
+	defer clean()
+	if getMountpointFstype(parent) == "tmpfs" {
+		t.Skipf("%s lies on tmpfs", parent)
+	}
+
+	upper, work := path.Join(parent, "fs"), path.Join(parent, "work")
+	for _, dir := range []string{upper, work} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("failed to create dir: %v", err)
+		}
+	}
+
+	origin := GQuotaDriver
+	defer func() { GQuotaDriver = origin }()
+	quotaID := QuotaMinID + 1
+	driver := &PrjQuotaDriver{
+		quotaIDs: map[uint32]struct{}{quotaID: {}},
+		lastID:   quotaID,
+	}
+	GQuotaDriver = driver
+
+	// the upper and work dirs share the quota id, it is cleared and released once.
+	runner.attrs[upper] = fmt.Sprint(quotaID)
+	runner.attrs[work] = fmt.Sprint(quotaID)
+	if err := ReleaseRootfsQuota(upper, work); err != nil {
+		t.Fatalf("failed to release rootfs quota: %v", err)
+	}
+	setquota := runner.executed("setquota")
+	if len(setquota) != 1 || strings.Join(setquota[0][2:6], " ") != fmt.Sprintf("%d 0 0 0", quotaID) {
+		t.Fatalf("expect quota of quota id %d cleared once, got %v", quotaID, setquota)
+	}
+	if _, ok := driver.quotaIDs[quotaID]; ok {
+		t.Fatalf("expect quota id %d released", quotaID)
+	}
+}
+
+func TestVerifyRootfsQuotaNotEnforced(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	parent, clean := newTestDir(t)
+	defer clean()
+	if getMountpointFstype(parent) == "tmpfs" {
+		t.Skipf("%s lies on tmpfs", parent)
+	}
+
+	upper, work := path.Join(parent, "fs"), path.Join(parent, "work")
+	for _, dir := range []string{upper, work} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("failed to create dir: %v", err)
+		}
+	}
+
+	origin, originTTL := GQuotaDriver, quotaIDCacheTTL
+	defer func() {
+		GQuotaDriver, quotaIDCacheTTL = origin, originTTL
+	}()
+	quotaIDCacheTTL = 0
+	driver := &PrjQuotaDriver{
+		quotaIDs: make(map[uint32]struct{}),
+		lastID:   QuotaMinID,
+	}
+	GQuotaDriver = driver
+
+	// no quota id is allocated if project quota can not be enforced.
+	runner.results["tune2fs"] = []fakeResult{{stdout: noProjectFeature}, {stdout: noProjectFeature}}
+	id, err := VerifyRootfsQuota(upper, work, "10m", 0)
+	if err != nil {
+		t.Fatalf("failed to verify rootfs quota: %v", err)
+	}
+	if id != 0 || len(driver.quotaIDs) != 0 {
+		t.Fatalf("expect no quota id allocated, got %d, ids %v", id, driver.quotaIDs)
+	}
+	for _, bin := range []string{"mount", "setquota", "chattr"} {
+		if cmds := runner.executed(bin); len(cmds) != 0 {
+			t.Fatalf("expect no %s, got %v", bin, cmds)
+		}
+	}
+
+	// the quota id allocated is released if failing to set quota.
+	runner.results["setquota"] = []fakeResult{{exit: 1, err: fmt.Errorf("exit status 1")}}
+	if _, err := VerifyRootfsQuota(upper, work, "10m", 0); err == nil {
+		t.Fatalf("expect error when failing to set quota")
+	}
+	if len(driver.quotaIDs) != 0 || len(driver.quotaDirs) != 0 {
+		t.Fatalf("expect quota id released, got ids %v, dirs %v", driver.quotaIDs, driver.quotaDirs)
+	}
+}
+
+func TestPrepareQuotaDir(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+
+	origin, originTTL := GQuotaDriver, quotaIDCacheTTL
+	defer func() {
+		GQuotaDriver, quotaIDCacheTTL = origin, originTTL
+	}()
+	quotaIDCacheTTL = 0
+	GQuotaDriver = &PrjQuotaDriver{
+		quotaIDs: make(map[uint32]struct{}),
+		lastID:   QuotaMinID,
+	}
+
+	if err := PrepareQuotaDir(dir, 0); err == nil {
+		t.Fatalf("expect error on quota id 0")
+	}
+
+	// the new dir is set with quota id and inherit flag, not recursively.
+	id := QuotaMinID + 1
+	if err := PrepareQuotaDir(dir, id); err != nil {
+		t.Fatalf("failed to prepare quota dir: %v", err)
+	}
+	chattr := runner.executed("chattr")
+	if len(chattr) != 1 || strings.Join(chattr[0], " ") != fmt.Sprintf("chattr -p %d +P %s", id, dir) {
+		t.Fatalf("expect quota id set with inherit flag on %s, got %v", dir, chattr)
+	}
+
+	// the dir which already holds the quota id is left as it is.
+	if err := PrepareQuotaDir(dir, id); err != nil {
+		t.Fatalf("failed to prepare quota dir again: %v", err)
+	}
+	if chattr := runner.executed("chattr"); len(chattr) != 1 {
+		t.Fatalf("expect no chattr on prepared dir, got %v", chattr)
+	}
+
+	// the limit is set by SetDiskQuota later.
+	if setquota := runner.executed("setquota"); len(setquota) != 0 {
+		t.Fatalf("expect no setquota when preparing dir, got %v", setquota)
+	}
+}
@@ -0,0 +1,215 @@
+// +build linux
+
+package quota
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/alibaba/pouch/pkg/bytefmt"
+	"github.com/alibaba/pouch/pkg/log"
+
+	"github.com/pkg/errors"
+)
+
+// hostTmpfsDirs are the tmpfs mounts shared by the host, the size of them is never set.
+var hostTmpfsDirs = []string{"/dev", "/dev/shm", "/run", "/run/lock", "/run/user", "/tmp", "/sys/fs/cgroup"}
+
+// TmpfsQuotaDriver represents tmpfs quota driver.
+// tmpfs supports neither project quota nor group quota, so the quota is set by
+// remounting tmpfs with `size=` option. Pay attention, it is a cap of the whole
+// tmpfs mount, not of the subtree of the directory, and quota ID is not used.
+type TmpfsQuotaDriver struct {
+	// tools saves the configured paths of quota tools.
+	tools toolPaths
+	// denyDirs saves the directories which quota is never applied on, besides the host root.
+	denyDirs []string
+}
+
+// EnforceQuota is used to enforce disk quota effect on specified directory.
+func (quota *TmpfsQuotaDriver) EnforceQuota(dir string) (*MountInfo, error) {
+	log.WithFields(nil, map[string]interface{}{"dir": dir}).Debugf("start tmpfs quota driver")
+
+	devID, err := getDevID(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get device id for directory: (%s)", dir)
+	}
+
+	mountPoint, _, fsType := quota.CheckMountpoint(devID)
+	if mountPoint == "" {
+		return nil, fmt.Errorf("mountPoint not found for the device on which dir (%s) lies", dir)
+	}
+	if fsType != "tmpfs" {
+		return nil, fmt.Errorf("dir (%s) lies on (%s) filesystem, not tmpfs", dir, fsType)
+	}
+
+	return &MountInfo{
+		MountPoint: mountPoint,
+		DeviceID:   devID,
+		FsType:     fsType,
+	}, nil
+}
+
+// SetDiskQuota remounts the tmpfs on which directory lies with the size.
+// The directory must be the root of a tmpfs mount dedicated to it, and the size
+// must not be less than the disk usage of the mount.
+func (quota *TmpfsQuotaDriver) SetDiskQuota(dir string, size string, quotaID uint32) error {
+	_, err := quota.SetDiskQuotaWithResult(dir, size, quotaID)
+	return err
+}
+
+// SetDiskQuotaWithResult works as SetDiskQuota, and returns the mountpoint and
+// filesystem type which are actually used, the quota ID is always 0.
+func (quota *TmpfsQuotaDriver) SetDiskQuotaWithResult(dir string, size string, quotaID uint32) (*SetQuotaResult, error) {
+	log.WithFields(nil, map[string]interface{}{"dir": dir, "quotaID": quotaID}).Debugf("set disk quota, size: %s", size)
+
+	denyDirs := append(append([]string{}, quota.denyDirs...), hostTmpfsDirs...)
+	if err := checkQuotaDir(dir, denyDirs); err != nil {
+		return nil, err
+	}
+
+	mountInfo, err := quota.EnforceQuota(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to enforce quota, dir: (%s)", dir)
+	}
+
+	if err := checkTmpfsDedicated(dir, mountInfo); err != nil {
+		return nil, err
+	}
+
+	limit, err := bytefmt.ToBytes(size)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to change size: (%s) to bytes", size)
+	}
+
+	stfs, err := getDevStatfs(mountInfo)
+	if err != nil {
+		return nil, err
+	}
+	if used := (stfs.Blocks - stfs.Bfree) * devBlockSize(stfs); limit < used {
+		return nil, errors.Errorf("size (%d bytes) is less than the disk usage (%d bytes) of tmpfs (%s)",
+			limit, used, mountInfo.MountPoint)
+	}
+
+	if err := quota.setSize(limit, mountInfo); err != nil {
+		return nil, err
+	}
+
+	return &SetQuotaResult{
+		MountPoint: mountInfo.MountPoint,
+		FsType:     mountInfo.FsType,
+	}, nil
+}
+
+// checkTmpfsDedicated returns error unless the directory is the root of a tmpfs mount
+// which is mounted only once. The size is a cap of the whole mount, remounting the tmpfs
+// shared with the host or other containers limits all of them.
+func checkTmpfsDedicated(dir string, mountInfo *MountInfo) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to stat dir(%s)", dir)
+	}
+	mp, err := os.Stat(mountInfo.MountPoint)
+	if err != nil {
+		return errors.Wrapf(err, "failed to stat mountpoint(%s)", mountInfo.MountPoint)
+	}
+	if !os.SameFile(fi, mp) {
+		return errors.Errorf("dir (%s) is not the root of tmpfs mountpoint (%s), the tmpfs may be shared",
+			dir, mountInfo.MountPoint)
+	}
+
+	mounts, err := readMounts()
+	if err != nil {
+		return errors.Wrapf(err, "failed to read file(%s)", procMountFile)
+	}
+	var count int
+	for _, m := range mounts {
+		if m.fsType != "tmpfs" {
+			continue
+		}
+		if devID, _ := mountDevID(m.mountPoint); devID == mountInfo.DeviceID {
+			count++
+		}
+	}
+	if count > 1 {
+		return errors.Errorf("tmpfs mountpoint (%s) of dir (%s) is mounted (%d) times, the tmpfs is shared",
+			mountInfo.MountPoint, dir, count)
+	}
+	return nil
+}
+
+// setSize remounts tmpfs with the size option.
+// mount -o remount,size=$size $mountpoint
+func (quota *TmpfsQuotaDriver) setSize(limit uint64, mountInfo *MountInfo) error {
+	mountPoint := mountInfo.MountPoint
+	opt := "remount,size=" + strconv.FormatUint(limit, 10)
+
+	exit, stdout, stderr, err := execRun(0, quota.tools.path("mount"), "-o", opt, mountPoint)
+	log.WithFields(nil, map[string]interface{}{"devID": mountInfo.DeviceID, "fstype": mountInfo.FsType, "mountpoint": mountPoint}).
+		Infof("set tmpfs size, size: (%d bytes), stdout: (%s), stderr: (%s), exit: (%d)", limit, stdout, stderr, exit)
+	return errors.Wrapf(err, "failed to remount tmpfs, mountpoint: (%s), size: (%d bytes), stdout: (%s), stderr: (%s), exit: (%d)",
+		mountPoint, limit, stdout, stderr, exit)
+}
+
+// CheckMountpoint is used to check mount point.
+// It returns mointpoint, whether the size is set and filesystem type of the device.
+//
+// tmpfs /run tmpfs rw,nosuid,nodev,size=1024k,mode=755 0 0
+func (quota *TmpfsQuotaDriver) CheckMountpoint(devID uint64) (string, bool, string) {
+	log.WithFields(nil, map[string]interface{}{"devID": devID}).Debugf("check mountpoint")
+	mount, err := findDeviceMount(devID)
+	if err != nil {
+		log.WithFields(nil, map[string]interface{}{"devID": devID}).
+			Warnf("failed to read file: (%s), err: (%v)", procMountFile, err)
+		return "", false, ""
+	}
+	if mount == nil {
+		return "", false, ""
+	}
+
+	return mount.mountPoint, mount.hasOption("size"), mount.fsType
+}
+
+// GetQuotaIDInFileAttr always returns 0, since tmpfs does not use quota ID.
+func (quota *TmpfsQuotaDriver) GetQuotaIDInFileAttr(dir string) uint32 {
+	return 0
+}
+
+// SetQuotaIDInFileAttr does nothing, since tmpfs does not use quota ID.
+func (quota *TmpfsQuotaDriver) SetQuotaIDInFileAttr(dir string, quotaID uint32) error {
+	return nil
+}
+
+// GetNextQuotaID returns error, since tmpfs does not use quota ID.
+func (quota *TmpfsQuotaDriver) GetNextQuotaID() (uint32, error) {
+	return 0, errors.Errorf("tmpfs quota driver does not support quota id")
+}
+
+// SetFileAttrRecursive does nothing, since tmpfs does not use quota ID.
+func (quota *TmpfsQuotaDriver) SetFileAttrRecursive(dir string, quotaID uint32) error {
+	return nil
+}
+
+// GetDiskQuota returns the disk usage and size of the tmpfs mount which directory lies on,
+// the quota ID is always 0.
+func (quota *TmpfsQuotaDriver) GetDiskQuota(dir string) (*QuotaUsage, error) {
+	devID, err := getDevID(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get device id for directory: (%s)", dir)
+	}
+	mountPoint, _, fsType := quota.CheckMountpoint(devID)
+	if mountPoint == "" {
+		return nil, errors.Errorf("mountPoint not found for the device on which dir (%s) lies", dir)
+	}
+
+	stfs, err := getDevStatfs(&MountInfo{MountPoint: mountPoint, DeviceID: devID, FsType: fsType})
+	if err != nil {
+		return nil, err
+	}
+	blockSize := devBlockSize(stfs)
+	return &QuotaUsage{
+		Used:  (stfs.Blocks - stfs.Bfree) * blockSize,
+		Limit: stfs.Blocks * blockSize,
+	}, nil
+}
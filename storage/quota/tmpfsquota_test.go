@@ -0,0 +1,121 @@
+// +build linux
+
+package quota
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestTmpfsQuotaSetSize(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	driver := &TmpfsQuotaDriver{}
+	mountInfo := &MountInfo{
+		MountPoint: "/var/lib/pouch/tmpfs",
+		FsType:     "tmpfs",
+	}
+	if err := driver.setSize(10*1024*1024, mountInfo); err != nil {
+		t.Fatalf("failed to set tmpfs size: %v", err)
+	}
+
+	expect := [][]string{{"mount", "-o", "remount,size=10485760", "/var/lib/pouch/tmpfs"}}
+	if got := runner.executed("mount"); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect commands %v, got %v", expect, got)
+	}
+}
+
+func TestTmpfsQuotaSetDiskQuotaGuard(t *testing.T) {
+	runner, restore := newFakeRunner()
+	defer restore()
+
+	dir, clean := newTestDir(t)
+	defer clean()
+	devID, err := getDevID(dir)
+	if err != nil {
+		t.Fatalf("failed to get dev id of %s: %v", dir, err)
+	}
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatalf("failed to create %s: %v", sub, err)
+	}
+
+	f, err := ioutil.TempFile("", "mounts")
+	if err != nil {
+		t.Fatalf("failed to create mounts fixture: %v", err)
+	}
+	defer os.Remove(f.Name())
+	writeMounts := func(mountPoints ...string) {
+		var data string
+		for _, mp := range mountPoints {
+			data += fmt.Sprintf("tmpfs %s tmpfs rw,size=4096k 0 0\n", mp)
+		}
+		if err := ioutil.WriteFile(f.Name(), []byte(data), 0644); err != nil {
+			t.Fatalf("failed to write mounts fixture: %v", err)
+		}
+	}
+
+	originFile, originDevID, originStatfs := procMountFile, mountDevID, statfs
+	defer func() {
+		procMountFile, mountDevID, statfs = originFile, originDevID, originStatfs
+	}()
+	procMountFile = f.Name()
+	mountDevID = func(mp string) (uint64, error) {
+		return devID, nil
+	}
+	// 1m is in use.
+	statfs = func(path string, buf *syscall.Statfs_t) error {
+		buf.Bsize = 4096
+		buf.Blocks = 1024
+		buf.Bfree = 768
+		return nil
+	}
+
+	driver := &TmpfsQuotaDriver{}
+
+	// the subdirectory shares the tmpfs with its parent.
+	writeMounts(dir)
+	if _, err := driver.SetDiskQuotaWithResult(sub, "2m", 0); err == nil {
+		t.Fatalf("expect error of subdirectory of tmpfs")
+	}
+
+	// the tmpfs is mounted twice, such as by bind mount.
+	writeMounts(dir, sub)
+	if _, err := driver.SetDiskQuotaWithResult(dir, "2m", 0); err == nil {
+		t.Fatalf("expect error of tmpfs mounted twice")
+	}
+
+	writeMounts(dir)
+	if _, err := driver.SetDiskQuotaWithResult(dir, "512k", 0); err == nil {
+		t.Fatalf("expect error of size less than the disk usage")
+	}
+
+	denied := &TmpfsQuotaDriver{denyDirs: []string{dir}}
+	if _, err := denied.SetDiskQuotaWithResult(dir, "2m", 0); errors.Cause(err) != ErrQuotaDirDenied {
+		t.Fatalf("expect ErrQuotaDirDenied for %s, got %v", dir, err)
+	}
+
+	if mount := runner.executed("mount"); len(mount) != 0 {
+		t.Fatalf("expect no remount, got %v", mount)
+	}
+
+	result, err := driver.SetDiskQuotaWithResult(dir, "2m", 0)
+	if err != nil {
+		t.Fatalf("failed to set disk quota on dedicated tmpfs: %v", err)
+	}
+	if result.MountPoint != dir || result.FsType != "tmpfs" {
+		t.Fatalf("expect result of tmpfs on %s, got %+v", dir, result)
+	}
+	expect := [][]string{{"mount", "-o", "remount,size=2097152", dir}}
+	if got := runner.executed("mount"); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect commands %v, got %v", expect, got)
+	}
+}
@@ -23,3 +23,65 @@ type MountInfo struct {
 	FsType     string
 	DeviceID   uint64
 }
+
+// SetQuotaResult defines the result of setting disk quota for a directory.
+type SetQuotaResult struct {
+	QuotaID    uint32
+	MountPoint string
+	FsType     string
+}
+
+// QuotaUsage defines the disk usage and limit of a quota id, in bytes.
+type QuotaUsage struct {
+	QuotaID   uint32
+	Used      uint64
+	Limit     uint64
+	SoftLimit uint64
+}
+
+// DiskQuotaReport defines the quota usage of a directory together with the space of
+// the filesystem it lies on, which tells whether the quota or the filesystem is full.
+type DiskQuotaReport struct {
+	Quota *QuotaUsage
+
+	// FsSize, FsFree and FsAvail are the size, the free space and the space available
+	// to unprivileged users of the filesystem, in bytes.
+	FsSize  uint64
+	FsFree  uint64
+	FsAvail uint64
+}
+
+// QuotaDriverState defines a snapshot of the internal state of project quota driver,
+// which is used for diagnostics.
+type QuotaDriverState struct {
+	// LastID is the last quota id scanned for allocation.
+	LastID uint32
+
+	// AllocatedIDs is the number of quota ids in use, FreeIDs are the ones
+	// scanned and not allocated yet.
+	AllocatedIDs int
+	FreeIDs      []uint32
+
+	// QuotaDirs maps quota id to the directory it is allocated for by driver.
+	QuotaDirs map[uint32]string
+
+	// AppliedDirs and SuspendedDirs are the directories whose quota is applied
+	// or suspended by driver, sorted.
+	AppliedDirs   []string
+	SuspendedDirs []string
+
+	// Devices are the ids of devices which quota has been enforced on, sorted.
+	Devices []uint64
+}
+
+// toolPaths defines the paths of quota tools.
+// key: tool name, value: path of the tool.
+type toolPaths map[string]string
+
+// path returns the path of tool, it returns the tool name to be looked up in PATH if not set.
+func (t toolPaths) path(tool string) string {
+	if p, ok := t[tool]; ok && p != "" {
+		return p
+	}
+	return tool
+}
@@ -86,6 +86,15 @@ func (p *Local) Create(ctx context.Context, id types.VolumeContext) (*types.Volu
 		return nil, fmt.Errorf("mount path is not a dir %s", mountPath)
 	}
 
+	// the volume is limited by its own quota id, which is shared by all
+	// the containers using it. The failure does not fail the creation, such
+	// as the host does not support quota, since quota is set again on attach.
+	if size != "" && size != "0" {
+		if _, err := quota.SetVolumeQuota(mountPath, size); err != nil {
+			log.With(ctx).Warnf("failed to set quota of volume %s: %v", id.Name, err)
+		}
+	}
+
 	return types.NewVolumeFromContext(mountPath, size, id), nil
 }
 
@@ -94,9 +103,17 @@ func (p *Local) Remove(ctx context.Context, v *types.Volume) error {
 	log.With(ctx).Debugf("Local remove volume: %s", v.Name)
 	mountPath := v.Path()
 
+	// the quota id of volume is released before its directory is removed.
+	if size := v.Size(); size != "" && size != "0" {
+		if err := quota.ReleaseVolumeQuota(mountPath); err != nil {
+			log.With(ctx).Warnf("failed to release quota of volume %s: %v", v.Name, err)
+		}
+	}
+
 	if err := os.RemoveAll(mountPath); err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("remove %q directory failed, err: %v", mountPath, err)
 	}
+	quota.StopPolling(mountPath)
 
 	return nil
 }
@@ -151,7 +168,7 @@ func (p *Local) Attach(ctx context.Context, v *types.Volume) error {
 	}
 
 	if size != "" && size != "0" {
-		if ex := quota.SetDiskQuota(mountPath, size, 0); ex != nil {
+		if _, ex := quota.SetVolumeQuota(mountPath, size); ex != nil {
 			return ex
 		}
 	}
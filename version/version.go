@@ -11,6 +11,9 @@ var (
 	// APIVersion means the api version daemon serves
 	APIVersion = "1.24"
 
+	// MinAPIVersion means the minimum api version daemon supports
+	MinAPIVersion = "1.24"
+
 	// GitCommit is the commit id to build Pouch
 	GitCommit = "unknown"
 )